@@ -4,10 +4,13 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// GitlabProvider is the provider of deployments on GitLab
+const GitlabProvider = "gitlab"
+
 // Deployment tells us about our deployment
 type Deployment struct {
 	Status DeploymentStatus `json:"statuses,omitempty"`
-	// Current Sha
+	// Current Sha, a new deployment is created whenever this changes
 	Sha string `json:"sha,omitempty"`
 	// Owner
 	Owner string `json:"owner,omitempty"`
@@ -17,6 +20,12 @@ type Deployment struct {
 	Ref string `json:"ref,omitempty"`
 	// ID
 	ID int64 `json:"id,omitempty"`
+	// Provider is where the repo lives, GitHub if empty
+	// +optional
+	Provider string `json:"provider,omitempty"`
+	// PullRequest is the number of the PR, or the iid of the merge request
+	// +optional
+	PullRequest int `json:"pullRequest,omitempty"`
 }
 
 // DeploymentStatus tells us about a deployment for some Sha
@@ -27,6 +36,21 @@ type DeploymentStatus struct {
 	State string `json:"state,omitempty"`
 }
 
+// DeploymentRecord is a deployment we've created on Github
+type DeploymentRecord struct {
+	// ID
+	ID int64 `json:"id"`
+	// Sha
+	Sha string `json:"sha,omitempty"`
+}
+
+// GithubDeploymentStatus tells us what we've told Github
+type GithubDeploymentStatus struct {
+	DeploymentStatus `json:",inline"`
+	// History holds the most recent deployments, the latest one last
+	History []DeploymentRecord `json:"history,omitempty"`
+}
+
 // +kubebuilder:object:root=true
 
 // GithubDeployment is the Schema for the githubdeployment API
@@ -34,8 +58,8 @@ type GithubDeployment struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec   Deployment       `json:"spec,omitempty"`
-	Status DeploymentStatus `json:"status,omitempty"`
+	Spec   Deployment             `json:"spec,omitempty"`
+	Status GithubDeploymentStatus `json:"status,omitempty"`
 }
 
 // +kubebuilder:object:root=true
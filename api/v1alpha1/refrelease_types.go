@@ -1,9 +1,15 @@
 package v1alpha1
 
 import (
+	"time"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// RestartedAtAnnotation on a RefRelease is copied to the pod template of
+// flux, restarting it whenever it changes
+const RestartedAtAnnotation = "deploy.properator.io/restartedAt"
+
 // Ref tells us which version of our repo to track
 type Ref struct {
 	// +optional
@@ -14,13 +20,46 @@ type Ref struct {
 	Tag string `json:"tag,omitempty"`
 	// +optional
 	PullRequest int `json:"pullRequest,omitempty"`
+	// Pinned keeps flux at Sha instead of following Branch
+	// +optional
+	Pinned bool `json:"pinned,omitempty"`
 }
 
+// Ways flux authenticates with a repo
+const (
+	// SSHAuth uses the deploy key in KeySecretName
+	SSHAuth = "ssh"
+	// TokenAuth uses installation tokens of our GitHub app over HTTPS
+	TokenAuth = "token"
+)
+
 // Repo defines the Github repo
 type Repo struct {
 	Owner         string `json:"owner,omitempty"`
 	Name          string `json:"name,omitempty"`
 	KeySecretName string `json:"keySecretName,omitempty"`
+	// URL is cloned instead of the GitHub repo if set
+	// +optional
+	URL string `json:"url,omitempty"`
+	// Auth is how flux authenticates with the repo, ssh if empty
+	// +optional
+	// +kubebuilder:validation:Enum=ssh;token
+	Auth string `json:"auth,omitempty"`
+}
+
+// Expiry drops an environment once it's been around or idle for too long
+type Expiry struct {
+	// TTL is how long the environment lives after it was deployed or
+	// extended
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+	// Idle is how long the environment lives without new commits
+	// +optional
+	Idle *metav1.Duration `json:"idle,omitempty"`
+	// ExtendedAt is when the environment was last deployed or extended,
+	// its creation if unset
+	// +optional
+	ExtendedAt *metav1.Time `json:"extendedAt,omitempty"`
 }
 
 // RefReleaseSpec defines the desired state of RefRelease
@@ -30,12 +69,27 @@ type RefReleaseSpec struct {
 	// Repo refers to either a branch, tag or commit along with a pull request
 	// number
 	Ref Ref `json:"ref,omitempty"`
+	// Path restricts flux to a comma separated list of paths in the repo
+	// +optional
+	Path string `json:"path,omitempty"`
+	// Expiry drops the environment after some time, never if unset
+	// +optional
+	Expiry *Expiry `json:"expiry,omitempty"`
 }
 
 // RefReleaseStatus defines the observed state of RefRelease
 type RefReleaseStatus struct {
 	// Deployment status determines the deployment URL
 	DeploymentURL string `json:"deploymentURL,omitempty"`
+	// Sha is the last commit we've seen
+	// +optional
+	Sha string `json:"sha,omitempty"`
+	// UpdatedAt is when we first saw Sha
+	// +optional
+	UpdatedAt *metav1.Time `json:"updatedAt,omitempty"`
+	// Warned is the expiry the PR was last warned about
+	// +optional
+	Warned *metav1.Time `json:"warned,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -58,6 +112,37 @@ type RefReleaseList struct {
 	Items           []RefRelease `json:"items"`
 }
 
+// ExpiresAt is when the environment of r is dropped, false if never.
+func (r *RefRelease) ExpiresAt() (time.Time, bool) {
+	expiry := r.Spec.Expiry
+	if expiry == nil {
+		return time.Time{}, false
+	}
+
+	start := r.CreationTimestamp.Time
+	if expiry.ExtendedAt != nil {
+		start = expiry.ExtendedAt.Time
+	}
+
+	var expires time.Time
+	if expiry.TTL != nil && expiry.TTL.Duration > 0 {
+		expires = start.Add(expiry.TTL.Duration)
+	}
+
+	if expiry.Idle != nil && expiry.Idle.Duration > 0 {
+		active := start
+		if updated := r.Status.UpdatedAt; updated != nil && updated.After(active) {
+			active = updated.Time
+		}
+
+		if idle := active.Add(expiry.Idle.Duration); expires.IsZero() || idle.Before(expires) {
+			expires = idle
+		}
+	}
+
+	return expires, !expires.IsZero()
+}
+
 func init() {
 	SchemeBuilder.Register(&RefRelease{}, &RefReleaseList{})
 }
@@ -0,0 +1,43 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WebhookEventSpec holds a webhook delivery from Github
+type WebhookEventSpec struct {
+	// Type is the event type from the X-GitHub-Event header
+	Type string `json:"type"`
+	// DeliveryID is from the X-GitHub-Delivery header
+	// +optional
+	DeliveryID string `json:"deliveryID,omitempty"`
+	// ReceivedAt determines the order events are handled in
+	ReceivedAt metav1.MicroTime `json:"receivedAt"`
+	// Payload is the validated body of the delivery, dropped once the
+	// event has been handled
+	// +optional
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// WebhookEvent is the Schema for the webhookevents API
+type WebhookEvent struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec WebhookEventSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// WebhookEventList contains a list of WebhookEvent
+type WebhookEventList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []WebhookEvent `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&WebhookEvent{}, &WebhookEventList{})
+}
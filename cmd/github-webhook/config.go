@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
+	"github.com/pkg/errors"
+)
+
+// configFlags are the flags making up a githubwebhook.Config. The webhook and
+// replay share them so events are replayed the way the webhook handles them.
+type configFlags struct {
+	permissions, teams, deployLabel, forks, keyType, gitAuth, namespaceConfig string
+
+	debounce, ttl, idleTTL, closedRetention time.Duration
+}
+
+// addConfigFlags registers the flags of a githubwebhook.Config.
+func addConfigFlags(flags *flag.FlagSet) *configFlags {
+	var f configFlags
+
+	flags.StringVar(&f.permissions, "permissions", githubwebhook.DefaultPermissions,
+		"Minimum repository permission (read, write or admin) needed for each command.")
+	flags.StringVar(&f.teams, "teams", "",
+		"Comma separated org/team slugs, one of which commenters must be a member of "+
+			"to use commands needing more than read permission.")
+	flags.StringVar(&f.deployLabel, "deploy-label", "",
+		"Deploy PRs while they have this label. Disabled if empty.")
+	flags.StringVar(&f.forks, "forks", githubwebhook.ForksDeny,
+		"Whether PRs from forks are deployed: deny, approve (once someone with write permission approved the commit) or allow.")
+	flags.StringVar(&f.keyType, "deploy-key-type", githubwebhook.KeyRSA, "Type of new deploy keys: rsa or ed25519.")
+	flags.StringVar(&f.gitAuth, "git-auth", deployv1alpha1.SSHAuth,
+		"How flux authenticates with GitHub repos: ssh with deploy keys or token with installation tokens over HTTPS.")
+	flags.DurationVar(&f.ttl, "ttl", 0,
+		"Drop environments this long after they were deployed or extended, unless deploy is given a ttl. Disabled if 0.")
+	flags.DurationVar(&f.idleTTL, "idle-ttl", 0, "Drop environments after this long without new commits. Disabled if 0.")
+	flags.StringVar(&f.namespaceConfig, "namespace-config", "",
+		"YAML file with the name template, labels, annotations, ResourceQuota, LimitRange and NetworkPolicy "+
+			"of environment namespaces.")
+	flags.DurationVar(&f.debounce, "debounce", 30*time.Second,
+		"Skip an action on a PR if the same action succeeded this recently. Disabled if 0.")
+	flags.DurationVar(&f.closedRetention, "closed-retention", 30*24*time.Hour,
+		"How long to remember environments of closed PRs so they're restored when reopened. Forever if 0.")
+
+	return &f
+}
+
+// config parses the flags once they've been parsed themselves.
+func (f *configFlags) config() (githubwebhook.Config, error) {
+	config := githubwebhook.Config{
+		DeployLabel: f.deployLabel, Debounce: f.debounce, TTL: f.ttl, IdleTTL: f.idleTTL, ClosedRetention: f.closedRetention,
+	}
+
+	var err error
+
+	if config.Permissions, err = githubwebhook.ParsePermissions(f.permissions); err != nil {
+		return config, errors.Wrap(err, "invalid --permissions")
+	}
+
+	if config.Teams, err = githubwebhook.ParseTeams(f.teams); err != nil {
+		return config, errors.Wrap(err, "invalid --teams")
+	}
+
+	if config.Forks, err = githubwebhook.ParseForkPolicy(f.forks); err != nil {
+		return config, errors.Wrap(err, "invalid --forks")
+	}
+
+	if config.KeyType, err = githubwebhook.ParseKeyType(f.keyType); err != nil {
+		return config, errors.Wrap(err, "invalid --deploy-key-type")
+	}
+
+	if config.GitAuth, err = githubwebhook.ParseGitAuth(f.gitAuth); err != nil {
+		return config, errors.Wrap(err, "invalid --git-auth")
+	}
+
+	if config.Namespaces, err = githubwebhook.LoadNamespaceConfig(f.namespaceConfig); err != nil {
+		return config, errors.Wrap(err, "invalid --namespace-config")
+	}
+
+	return config, nil
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"flag"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
 	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
+	"github.com/michaelbeaumont/properator/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -28,9 +36,48 @@ func getClient() (client.Client, error) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replay(os.Args[2:]))
+	}
+
+	var archiveDir string
+
+	var archiveMax int
+
+	var workers int
+
+	var retention, shutdownTimeout, clientTTL time.Duration
+
+	configFlags := addConfigFlags(flag.CommandLine)
+	flag.IntVar(&workers, "workers", 4,
+		"Number of events handled in parallel. Events for the same PR are always handled in order.")
+	flag.DurationVar(&retention, "delivery-retention", 72*time.Hour,
+		"How long to remember webhook deliveries so redeliveries are skipped.")
+	flag.StringVar(&archiveDir, "archive-dir", "",
+		"Save validated deliveries to this directory so they can be replayed. Disabled if empty.")
+	flag.IntVar(&archiveMax, "archive-max", 1000, "Number of deliveries to keep in --archive-dir.")
+	flag.StringVar(&githubwebhook.SecretsDir, "secrets-dir", githubwebhook.SecretsDir,
+		"Directory holding WEBHOOK_SECRET, APP_ID and id_rsa of the GitHub app and the optional GITLAB_* secrets.")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 25*time.Second,
+		"How long to keep handling queued events after being asked to stop.")
+	flag.DurationVar(&clientTTL, "client-cache-ttl", time.Hour,
+		"How long to reuse GitHub clients of installations. Disabled if 0.")
+	flag.Parse()
+
 	log := ctrl.Log.WithName("webhook")
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
+	if workers < 1 {
+		log.Error(nil, "--workers must be at least 1")
+		os.Exit(1)
+	}
+
+	config, err := configFlags.config()
+	if err != nil {
+		log.Error(err, "invalid flags")
+		os.Exit(1)
+	}
+
 	k8s, err := getClient()
 
 	if err != nil {
@@ -44,33 +91,136 @@ func main() {
 		os.Exit(1)
 	}
 
-	setup, err := githubwebhook.SetupGhCli(context.Background())
+	setup, err := githubwebhook.SetupGhCli(context.Background(), clientTTL)
 	if err != nil {
 		log.Error(err, "failed to setup gh clients")
 		os.Exit(1)
 	}
 
-	events := make(chan interface{}, 200)
-	worker := githubwebhook.NewWebhookWorker(k8s, setup.CliForInstall, setup.Username, log)
+	namespace, err := utils.GetCurrentNamespace()
+	if err != nil {
+		log.Error(err, "couldn't get namespace to store events in")
+		os.Exit(1)
+	}
+
+	queue := githubwebhook.NewQueue(githubwebhook.NewResourceStore(k8s, namespace), 200, retention)
+	// Pick up events stored before a restart
+	if err := queue.Resync(context.Background()); err != nil {
+		log.Error(err, "couldn't load stored events")
+		os.Exit(1)
+	}
+
+	worker := githubwebhook.NewWebhookWorker(k8s, setup, config, log)
+
+	stop := make(chan struct{})
+	go queue.Run(stop, time.Minute, func(err error) {
+		log.Error(err, "couldn't sync stored events")
+	}, worker.PruneRecords)
+
+	gitlabCli, err := githubwebhook.SetupGitlab()
+	if err != nil {
+		log.Error(err, "failed to setup GitLab client")
+		os.Exit(1)
+	}
+
+	var gitlabToken []byte
+	if gitlabCli != nil {
+		if err := worker.EnableGitlab(context.Background(), gitlabCli); err != nil {
+			log.Error(err, "failed to enable GitLab")
+			os.Exit(1)
+		}
+
+		if gitlabToken, err = githubwebhook.GetSecret("GITLAB_WEBHOOK_SECRET"); err != nil {
+			log.Error(err, "couldn't get GitLab webhook secret")
+			os.Exit(1)
+		}
+	}
+
+	pool := githubwebhook.NewPool(&worker, queue, workers)
+
+	prometheus.MustRegister(githubwebhook.Collectors()...)
+	prometheus.MustRegister(pool.DepthGauge())
 
 	var wg sync.WaitGroup
 
 	wg.Add(1)
 
-	go worker.Worker(&wg, events)
+	go pool.Run(&wg)
+
+	var archive *githubwebhook.Archive
+	if archiveDir != "" {
+		if archive, err = githubwebhook.NewArchive(archiveDir, archiveMax); err != nil {
+			log.Error(err, "couldn't set up archive")
+			os.Exit(1)
+		}
+	}
 
-	wh := githubwebhook.NewWebhook(secret, events)
+	wh := githubwebhook.NewWebhook(secret, queue, archive, log)
 	Handler := http.NewServeMux()
 	Handler.Handle("/webhook", &wh)
+	Handler.Handle("/queue", pool)
+	Handler.Handle("/metrics", promhttp.Handler())
+	Handler.HandleFunc("/healthz", githubwebhook.Healthz)
+	checks := map[string]githubwebhook.Check{
+		"github":     githubwebhook.GithubCheck(setup.CliForApp),
+		"kubernetes": githubwebhook.KubernetesCheck(k8s, namespace),
+	}
+	if gitlabCli != nil {
+		Handler.Handle("/gitlab", githubwebhook.NewGitlabWebhook(bytes.TrimSpace(gitlabToken), &wh))
+		checks["gitlab"] = githubwebhook.GitlabCheck(gitlabCli)
+	}
+	Handler.Handle("/readyz", githubwebhook.Readyz(checks))
 
 	s := &http.Server{
 		Addr:    ":8080",
 		Handler: Handler,
 	}
 
-	log.Info("Listening", "port", "8080", "username", setup.Username)
-	log.Error(s.ListenAndServe(), "Failed to serve")
-	close(events)
-	wg.Wait()
-	os.Exit(1)
+	served := make(chan error, 1)
+
+	go func() {
+		log.Info("Listening", "port", "8080", "username", setup.Username)
+		served <- s.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	code := 0
+
+	select {
+	case err := <-served:
+		log.Error(err, "Failed to serve")
+
+		code = 1
+	case sig := <-signals:
+		log.Info("Shutting down", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Error(err, "couldn't stop serving")
+	}
+
+	close(stop)
+	queue.Close()
+
+	drained := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Info("Handled all queued events")
+	case <-ctx.Done():
+		// They're stored and handled after the next start
+		log.Info("Stopped before handling all queued events", "waiting", pool.Depth())
+	}
+
+	cancel()
+	os.Exit(code)
 }
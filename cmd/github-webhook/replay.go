@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
+	"github.com/michaelbeaumont/properator/pkg/utils"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+const replayUsage = `Usage: github-webhook replay [flags] <file>
+
+Handles a webhook payload as if it had just been delivered. The file is
+either an event archived with --archive-dir or, with --type, a raw payload.
+
+`
+
+// replay handles a stored payload against the cluster of a kubeconfig context.
+func replay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), replayUsage)
+		flags.PrintDefaults()
+	}
+
+	var kubeconfig, kubeContext, namespace, eventType string
+
+	var dryRun bool
+
+	flags.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Defaults to the usual kubectl rules.")
+	flags.StringVar(&kubeContext, "context", "", "Kubeconfig context to use. Defaults to the current context.")
+	flags.StringVar(&namespace, "namespace", "properator-system", "Namespace properator is running in.")
+	flags.StringVar(&eventType, "type", "",
+		"Event type, like pull_request or gitlab_note, for payloads that weren't archived by the webhook.")
+	flags.StringVar(&githubwebhook.SecretsDir, "secrets-dir", githubwebhook.SecretsDir,
+		"Directory holding APP_ID and id_rsa of the GitHub app and the optional GITLAB_* secrets.")
+	flags.BoolVar(&dryRun, "dry-run", false, "Only log what would be done.")
+	configFlags := addConfigFlags(flags)
+	_ = flags.Parse(args)
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	log := ctrl.Log.WithName("replay")
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	if err := os.Setenv(utils.NamespaceEnv, namespace); err != nil {
+		log.Error(err, "couldn't set namespace")
+		return 1
+	}
+
+	event, err := githubwebhook.LoadEvent(flags.Arg(0), eventType)
+	if err != nil {
+		log.Error(err, "couldn't load event")
+		return 1
+	}
+
+	config, err := configFlags.config()
+	if err != nil {
+		log.Error(err, "invalid flags")
+		return 1
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		rules, &clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+	).ClientConfig()
+	if err != nil {
+		log.Error(err, "couldn't load kubeconfig")
+		return 1
+	}
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = deployv1alpha1.AddToScheme(scheme)
+
+	k8s, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		log.Error(err, "problem creating client")
+		return 1
+	}
+
+	// One event doesn't need caching
+	setup, err := githubwebhook.SetupGhCli(context.Background(), 0)
+	if err != nil {
+		log.Error(err, "failed to setup gh clients")
+		return 1
+	}
+
+	worker := githubwebhook.NewWebhookWorker(k8s, setup, config, log)
+
+	gitlabCli, err := githubwebhook.SetupGitlab()
+	if err != nil {
+		log.Error(err, "failed to setup GitLab client")
+		return 1
+	}
+	if gitlabCli != nil {
+		if err := worker.EnableGitlab(context.Background(), gitlabCli); err != nil {
+			log.Error(err, "failed to enable GitLab")
+			return 1
+		}
+	}
+	if err := worker.Replay(event, dryRun); err != nil {
+		log.Error(err, "couldn't handle event", "type", event.Type, "delivery", event.DeliveryID)
+		return 1
+	}
+
+	return 0
+}
@@ -3,12 +3,13 @@ package main
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
+	"html/template"
 	"log"
 	"net"
 	"net/http"
 	"strings"
 
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
 	"github.com/pkg/errors"
 )
 
@@ -20,12 +21,22 @@ type CodeOrError struct {
 
 type listener struct {
 	flow chan CodeOrError
+	// githubURL is where the app is created
+	githubURL string
+	// tokenAuth asks for access to contents instead of deploy keys
+	tokenAuth bool
 }
 
 const serverError = 500
 
-func writePage(w http.ResponseWriter, page string) error {
-	bytes, err := ioutil.ReadFile(fmt.Sprintf("./cmd/init/%s.html", page))
+// page is what the HTML templates are given.
+type page struct {
+	GithubURL string
+	TokenAuth bool
+}
+
+func (l *listener) writePage(w http.ResponseWriter, name string) error {
+	tmpl, err := template.ParseFiles(fmt.Sprintf("./cmd/init/%s.html", name))
 	if err != nil {
 		w.WriteHeader(serverError)
 		return errors.Errorf("Couldn't load HTML: %v", err)
@@ -33,7 +44,7 @@ func writePage(w http.ResponseWriter, page string) error {
 
 	w.Header().Set("Content-Type", "text/html")
 
-	_, err = w.Write(bytes)
+	err = tmpl.Execute(w, page{l.githubURL, l.tokenAuth})
 	if err != nil {
 		w.WriteHeader(serverError)
 		return errors.Errorf("Couldn't load HTML: %v", err)
@@ -50,12 +61,12 @@ func (l *listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		code := q.Get("code")
 		l.flow <- CodeOrError{code, nil}
 
-		err := writePage(w, "finish")
+		err := l.writePage(w, "finish")
 		if err != nil {
 			l.flow <- CodeOrError{Err: err}
 		}
 	} else {
-		err := writePage(w, "create")
+		err := l.writePage(w, "create")
 		if err != nil {
 			l.flow <- CodeOrError{Err: err}
 		}
@@ -63,12 +74,20 @@ func (l *listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // StartFlow prompts the user to create a new app and listens for redirects.
-func StartFlow(ctx context.Context) (url string, recv chan CodeOrError, err error) {
+// With tokenAuth the app can read repos instead of adding deploy keys.
+func StartFlow(
+	ctx context.Context, endpoints githubwebhook.Endpoints, tokenAuth bool,
+) (url string, recv chan CodeOrError, err error) {
+	githubURL := "https://github.com"
+	if endpoints.IsEnterprise() {
+		githubURL = endpoints.URL
+	}
+
 	flow := make(chan CodeOrError, 1)
 	listenerFlow := make(chan CodeOrError, 1)
 	s := &http.Server{
 		Addr:    "127.0.0.1:0",
-		Handler: &listener{listenerFlow},
+		Handler: &listener{listenerFlow, githubURL, tokenAuth},
 	}
 
 	sock, err := net.Listen("tcp4", s.Addr)
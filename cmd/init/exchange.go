@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
 	"github.com/pkg/errors"
 )
 
@@ -25,18 +27,31 @@ func asEnv(key, value string) string {
 }
 
 // ToEnv creates an env file from Conversion info.
-func (c *Conversion) Output() ([]byte, []byte) {
+func (c *Conversion) Output(endpoints githubwebhook.Endpoints) ([]byte, []byte) {
 	b := strings.Builder{}
 	b.WriteString(asEnv("APP_ID", strconv.Itoa(c.ID)))
 	b.WriteString(asEnv("WEBHOOK_SECRET", c.WebhookSecret))
 
+	if endpoints.IsEnterprise() {
+		b.WriteString(asEnv("GITHUB_URL", endpoints.URL))
+	}
+
 	return []byte(b.String()), []byte(c.PEM)
 }
 
+// apiURL is the base of the REST API, ending in a slash.
+func apiURL(endpoints githubwebhook.Endpoints) string {
+	if endpoints.IsEnterprise() {
+		return endpoints.APIURL
+	}
+
+	return "https://api.github.com/"
+}
+
 // Exchange completes the app manifest flow
-func Exchange(code string) (*Conversion, error) {
+func Exchange(endpoints githubwebhook.Endpoints, code string) (*Conversion, error) {
 	conversionResp, err := http.Post(
-		fmt.Sprintf("https://api.github.com/app-manifests/%s/conversions", code),
+		fmt.Sprintf("%sapp-manifests/%s/conversions", apiURL(endpoints), code),
 		"application/json",
 		bytes.NewBufferString(""),
 	)
@@ -59,3 +74,34 @@ func Exchange(code string) (*Conversion, error) {
 
 	return &conversion, nil
 }
+
+// meta holds the interesting parts of the meta endpoint.
+type meta struct {
+	SSHKeys []string `json:"ssh_keys"`
+}
+
+// KnownHosts gets the SSH host keys of the git host in known_hosts format.
+func KnownHosts(endpoints githubwebhook.Endpoints) ([]byte, error) {
+	metaResp, err := http.Get(fmt.Sprintf("%smeta", apiURL(endpoints)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't get host keys")
+	}
+	defer metaResp.Body.Close()
+
+	m := meta{}
+	if err := json.NewDecoder(metaResp.Body).Decode(&m); err != nil {
+		return nil, errors.Wrapf(err, "error parsing returned host keys")
+	}
+
+	host := endpoints.SSHHost
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		host = fmt.Sprintf("[%s]:%s", h, port)
+	}
+
+	b := strings.Builder{}
+	for _, key := range m.SSHKeys {
+		b.WriteString(fmt.Sprintf("%s %s\n", host, key))
+	}
+
+	return []byte(b.String()), nil
+}
@@ -3,17 +3,20 @@ package main
 import (
 	"bufio"
 	"context"
+	"flag"
 	"io/ioutil"
 	"log"
 	"os"
 
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
 	"github.com/pkg/browser"
 	"github.com/pkg/errors"
 )
 
 const (
-	envFile = ".env"
-	keyFile = "id_rsa"
+	envFile        = ".env"
+	keyFile        = "id_rsa"
+	knownHostsFile = githubwebhook.KnownHostsSecret
 )
 
 func waitForInput() error {
@@ -23,8 +26,27 @@ func waitForInput() error {
 }
 
 func main() {
+	var githubURL string
+
+	var tokenAuth bool
+
+	flag.StringVar(&githubURL, "github-url", "",
+		"URL of your GitHub Enterprise Server, like https://github.example.com. Leave empty for github.com.")
+	flag.BoolVar(&tokenAuth, "token-auth", false,
+		"Let the app read repos for --git-auth=token instead of adding deploy keys.")
+	flag.Parse()
+
 	ctx := context.Background()
 
+	var endpoints githubwebhook.Endpoints
+
+	if githubURL != "" {
+		var err error
+		if endpoints, err = githubwebhook.EnterpriseEndpoints(githubURL); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	log.Println("Press Enter to begin app manifest flow and open browser.")
 
 	err := waitForInput()
@@ -32,7 +54,7 @@ func main() {
 		log.Fatal(errors.Wrapf(err, "couldn't get user input"))
 	}
 
-	url, codeOrErrorRecv, err := StartFlow(ctx)
+	url, codeOrErrorRecv, err := StartFlow(ctx, endpoints, tokenAuth)
 	if err != nil {
 		log.Fatal(errors.Wrapf(err, "couldn't start app manifest flow"))
 	}
@@ -49,12 +71,12 @@ func main() {
 	}
 	log.Println("Received code from GitHub.")
 
-	conversion, err := Exchange(codeOrError.Code)
+	conversion, err := Exchange(endpoints, codeOrError.Code)
 	if err != nil {
 		log.Fatal(errors.Wrapf(err, "Couldn't get app information"))
 	}
 
-	env, key := conversion.Output()
+	env, key := conversion.Output(endpoints)
 
 	err = ioutil.WriteFile(envFile, env, 0644)
 	if err != nil {
@@ -67,4 +89,18 @@ func main() {
 		log.Fatal(errors.Wrapf(err, "Couldn't write key to %s", keyFile))
 	}
 	log.Printf("Wrote key to %s\n", keyFile)
+
+	// flux already knows the keys of github.com
+	if endpoints.IsEnterprise() {
+		knownHosts, err := KnownHosts(endpoints)
+		if err != nil {
+			log.Fatal(errors.Wrapf(err, "Couldn't get SSH host keys"))
+		}
+
+		err = ioutil.WriteFile(knownHostsFile, knownHosts, 0644)
+		if err != nil {
+			log.Fatal(errors.Wrapf(err, "Couldn't write host keys to %s", knownHostsFile))
+		}
+		log.Printf("Wrote SSH host keys to %s\n", knownHostsFile)
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"os"
+	"time"
 
 	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -11,6 +12,7 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
 	"github.com/michaelbeaumont/properator/pkg/controllers"
@@ -34,37 +36,63 @@ func main() {
 
 	var enableLeaderElection bool
 
+	var clientTTL, keyRotation, expiryWarning time.Duration
+
+	var keyType string
+
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.DurationVar(&clientTTL, "client-cache-ttl", time.Hour,
+		"How long to reuse the GitHub installation of a repo and its client. Disabled if 0.")
+	flag.StringVar(&keyType, "deploy-key-type", githubwebhook.KeyRSA, "Type of new deploy keys: rsa or ed25519.")
+	flag.DurationVar(&keyRotation, "deploy-key-rotation", 0,
+		"Replace deploy keys once they're this old. Disabled if 0.")
+	flag.DurationVar(&expiryWarning, "expiry-warning", 24*time.Hour,
+		"How long before an environment expires its PR is warned.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
+	if _, err := githubwebhook.ParseKeyType(keyType); err != nil {
+		setupLog.Error(err, "invalid --deploy-key-type")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
 		Port:               9443,
 		LeaderElection:     enableLeaderElection,
 		LeaderElectionID:   "21195f66.properator.io",
+		NewCache:           controllers.NewCache,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	setup, err := githubwebhook.SetupGhCli(context.Background())
+	metrics.Registry.MustRegister(githubwebhook.GithubCollectors()...)
+
+	setup, err := githubwebhook.SetupGhCli(context.Background(), clientTTL)
 	if err != nil {
 		ctrl.Log.Error(err, "failed to setup gh clients")
 		os.Exit(1)
 	}
 
+	gitlabCli, err := githubwebhook.SetupGitlab()
+	if err != nil {
+		ctrl.Log.Error(err, "failed to setup GitLab client")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.RefReleaseReconciler{
 		Client:    mgr.GetClient(),
 		Log:       ctrl.Log.WithName("controllers").WithName("RefRelease"),
 		Scheme:    mgr.GetScheme(),
 		APIReader: mgr.GetAPIReader(),
+		Github:    setup.Endpoints,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "RefRelease")
 		os.Exit(1)
@@ -86,10 +114,60 @@ func main() {
 		Log:    ctrl.Log.WithName("controllers").WithName("GithubDeployment"),
 		Scheme: mgr.GetScheme(),
 		GhCli:  ghCli,
+		Gitlab: gitlabCli,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "GithubDeployment")
 		os.Exit(1)
 	}
+
+	if err = (&controllers.DeployKeyReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("DeployKey"),
+		Scheme:   mgr.GetScheme(),
+		GhCli:    ghCli,
+		Gitlab:   gitlabCli,
+		KeyType:  keyType,
+		Rotation: keyRotation,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DeployKey")
+		os.Exit(1)
+	}
+
+	if err = (&controllers.GitTokenReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("GitToken"),
+		Scheme: mgr.GetScheme(),
+		Token:  setup.RepoToken,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GitToken")
+		os.Exit(1)
+	}
+
+	if err = (&controllers.ExpiryReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("Expiry"),
+		Scheme:   mgr.GetScheme(),
+		GhCli:    ghCli,
+		Gitlab:   gitlabCli,
+		Username: setup.Username,
+		Warning:  expiryWarning,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Expiry")
+		os.Exit(1)
+	}
+
+	if err = (&controllers.FluxSyncReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("FluxSync"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "FluxSync")
+		os.Exit(1)
+	}
+	if err := controllers.LabelSecrets(mgr, ctrl.Log.WithName("controllers").WithName("Secrets")); err != nil {
+		setupLog.Error(err, "unable to label secrets")
+		os.Exit(1)
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	gh "github.com/google/go-github/v31/github"
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"github.com/pkg/errors"
+)
+
+// Deployer tells the code host of a repo about our deployments.
+type Deployer interface {
+	// CreateDeployment creates a deployment of the sha or ref of gd,
+	// returning its ID and sha.
+	CreateDeployment(ctx context.Context, gd *deployv1alpha1.GithubDeployment) (int64, string, error)
+	// CreateStatus reports the state of deployment id, which is one of
+	// GitHub's deployment states.
+	CreateStatus(ctx context.Context, gd *deployv1alpha1.GithubDeployment, id int64, state, url string) error
+}
+
+type githubDeployer struct {
+	cli *gh.Client
+}
+
+func (d *githubDeployer) CreateDeployment(
+	ctx context.Context, gd *deployv1alpha1.GithubDeployment,
+) (int64, string, error) {
+	environment := fmt.Sprintf("%s (%s)", baseEnvironment, gd.Spec.Ref)
+	ref := gd.Spec.Ref
+
+	if gd.Spec.Sha != "" {
+		ref = gd.Spec.Sha
+	}
+
+	depReq := gh.DeploymentRequest{
+		Ref:                  &ref,
+		Environment:          &environment,
+		AutoMerge:            &autoMerge,
+		TransientEnvironment: &transientEnvironment,
+	}
+	dep, _, err := d.cli.Repositories.CreateDeployment(ctx, gd.Spec.Owner, gd.Spec.Name, &depReq)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	return dep.GetID(), dep.GetSHA(), nil
+}
+
+func (d *githubDeployer) CreateStatus(
+	ctx context.Context, gd *deployv1alpha1.GithubDeployment, id int64, state, url string,
+) error {
+	status := gh.DeploymentStatusRequest{
+		State: &state,
+	}
+
+	if url != "" {
+		status.EnvironmentURL = &url
+	}
+
+	_, _, err := d.cli.Repositories.CreateDeploymentStatus(ctx, gd.Spec.Owner, gd.Spec.Name, id, &status)
+
+	return err
+}
+
+// gitlabStatuses maps GitHub deployment states to GitLab's.
+var gitlabStatuses = map[string]string{
+	"pending":     gitlab.DeploymentRunning,
+	"queued":      gitlab.DeploymentRunning,
+	"in_progress": gitlab.DeploymentRunning,
+	"success":     gitlab.DeploymentSuccess,
+	"failure":     gitlab.DeploymentFailed,
+	"error":       gitlab.DeploymentFailed,
+}
+
+type gitlabDeployer struct {
+	cli *gitlab.Client
+}
+
+// gitlabEnvironment groups our environments in a folder. GitLab doesn't
+// allow the parentheses we use on GitHub. Environments are named after the
+// merge request, since merge requests from different forks can have the
+// same branch name.
+func gitlabEnvironment(gd *deployv1alpha1.GithubDeployment) string {
+	// Deployments created before we knew the merge request keep their
+	// environment
+	if gd.Spec.PullRequest == 0 {
+		return fmt.Sprintf("%s/%s", baseEnvironment, gd.Spec.Ref)
+	}
+	return fmt.Sprintf("%s/mr-%d", baseEnvironment, gd.Spec.PullRequest)
+}
+
+func gitlabProject(gd *deployv1alpha1.GithubDeployment) string {
+	return gitlab.Project(gd.Spec.Owner + "/" + gd.Spec.Name)
+}
+
+func (d *gitlabDeployer) CreateDeployment(
+	ctx context.Context, gd *deployv1alpha1.GithubDeployment,
+) (int64, string, error) {
+	if gd.Spec.Sha == "" {
+		return 0, "", errors.New("GitLab deployments need a sha")
+	}
+
+	dep, err := d.cli.CreateDeployment(ctx, gitlabProject(gd), gitlabEnvironment(gd), gd.Spec.Ref, gd.Spec.Sha)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return dep.ID, dep.SHA, nil
+}
+
+func (d *gitlabDeployer) CreateStatus(
+	ctx context.Context, gd *deployv1alpha1.GithubDeployment, id int64, state, url string,
+) error {
+	if state == inactive {
+		// GitLab supersedes older deployments by itself
+		if id != gd.Spec.ID {
+			return nil
+		}
+
+		return d.cli.StopEnvironment(ctx, gitlabProject(gd), gitlabEnvironment(gd))
+	}
+
+	status, ok := gitlabStatuses[state]
+	if !ok {
+		return errors.Errorf("unknown deployment state %q", state)
+	}
+
+	// We create deployments running already
+	if status != gitlab.DeploymentRunning {
+		if err := d.cli.UpdateDeployment(ctx, gitlabProject(gd), id, status); err != nil {
+			return err
+		}
+	}
+
+	if url == "" {
+		return nil
+	}
+
+	return d.cli.SetEnvironmentURL(ctx, gitlabProject(gd), gitlabEnvironment(gd), url)
+}
@@ -0,0 +1,429 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"github.com/michaelbeaumont/properator/pkg/utils"
+)
+
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=deploy.properator.io,resources=refreleases,verbs=get;list;watch
+
+const (
+	removeKeyFinalizer = "finalizers.deploy.properator.io/remove-key"
+	// rotateAnnotation asks for a new key, whatever its value
+	rotateAnnotation = "deploy.properator.io/rotate"
+	// rotatedAnnotation is when the current key was added
+	rotatedAnnotation = "deploy.properator.io/key-rotated"
+	// previousKeyAnnotation is the ID of the key we replaced last
+	previousKeyAnnotation = "deploy.properator.io/previous-key-id"
+	// keySecretPrefix names the secrets the webhook keeps deploy keys in
+	keySecretPrefix = "properator-git-deploy-key-"
+	identityKey     = "identity"
+	// keyGrace is how long the webhook has to add a new key to its repo and
+	// flux has to pick up a new key before the previous one is removed.
+	keyGrace = 10 * time.Minute
+)
+
+// DeployKeyReconciler keeps track of the deploy keys the webhook creates,
+// replaces them and removes them from their repos along with their secrets.
+type DeployKeyReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	GhCli  ClientForOwnerRepo
+	Gitlab *gitlab.Client
+	// KeyType of new keys
+	KeyType string
+	// Rotation is how long a key is used before it's replaced, forever if 0
+	Rotation time.Duration
+}
+
+// Reconcile handles deploy key secrets.
+func (r *DeployKeyReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("secret", req.NamespacedName)
+
+	var secret v1.Secret
+	if err := r.Get(ctx, req.NamespacedName, &secret); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+
+	repo, err := r.repoOf(ctx, &secret)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if repo == "" {
+		log.Info("no repo known for deploy key")
+		return ctrl.Result{}, nil
+	}
+
+	owner, name := splitRepo(repo)
+
+	keys, err := r.keysFor(ctx, &secret, owner, name)
+	if err != nil {
+		log.Error(err, "unable to create client for the repo")
+
+		// We've lost access to the repo, so there's nothing to remove
+		if !secret.DeletionTimestamp.IsZero() && hasFinalizer(&secret, removeKeyFinalizer) {
+			controllerutil.RemoveFinalizer(&secret, removeKeyFinalizer)
+			return ctrl.Result{}, r.Update(ctx, &secret)
+		}
+
+		return resultFor(err)
+	}
+
+	if !secret.DeletionTimestamp.IsZero() {
+		return r.removeKeys(ctx, log, &secret, keys, owner, name)
+	}
+
+	if !hasFinalizer(&secret, removeKeyFinalizer) || secret.Annotations[githubwebhook.KeyRepoAnnotation] == "" {
+		controllerutil.AddFinalizer(&secret, removeKeyFinalizer)
+		secret.Annotations[githubwebhook.KeyRepoAnnotation] = repo
+
+		if err := r.Update(ctx, &secret); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	now := time.Now()
+	rotated := rotatedAt(&secret)
+
+	if _, ok := secret.Annotations[githubwebhook.KeyIDAnnotation]; !ok {
+		id, err := r.findKey(ctx, keys, &secret, owner, name)
+		if err != nil {
+			return resultFor(err)
+		}
+
+		if id == 0 {
+			// The webhook may still be adding the key
+			if wait := rotated.Add(keyGrace).Sub(now); wait > 0 {
+				return ctrl.Result{RequeueAfter: wait}, nil
+			}
+
+			log.Info("deploy key is missing from the repo")
+
+			return r.rotate(ctx, log, &secret, keys, owner, name)
+		}
+
+		secret.Annotations[githubwebhook.KeyIDAnnotation] = strconv.FormatInt(id, 10)
+		if err := r.Update(ctx, &secret); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	_, requested := secret.Annotations[rotateAnnotation]
+	if requested || (r.Rotation > 0 && !now.Before(rotated.Add(r.Rotation))) {
+		return r.rotate(ctx, log, &secret, keys, owner, name)
+	}
+
+	var result ctrl.Result
+	if r.Rotation > 0 {
+		result.RequeueAfter = rotated.Add(r.Rotation).Sub(now)
+	}
+
+	if previous, ok := secret.Annotations[previousKeyAnnotation]; ok {
+		if wait := rotated.Add(keyGrace).Sub(now); wait > 0 {
+			if result.RequeueAfter == 0 || wait < result.RequeueAfter {
+				result.RequeueAfter = wait
+			}
+		} else {
+			if err := removeKey(ctx, keys, owner, name, previous); err != nil {
+				return resultFor(err)
+			}
+
+			delete(secret.Annotations, previousKeyAnnotation)
+
+			if err := r.Update(ctx, &secret); err != nil {
+				return ctrl.Result{}, err
+			}
+
+			log.Info("removed previous deploy key", "id", previous)
+		}
+	}
+
+	return result, r.updateCopies(ctx, &secret)
+}
+
+// rotate replaces the key of secret with a new one. The previous key is kept
+// until flux had time to pick up the new key, so rotating again before then
+// waits until it's removed.
+func (r *DeployKeyReconciler) rotate(
+	ctx context.Context, log logr.Logger, secret *v1.Secret, keys deployKeys, owner, name string,
+) (ctrl.Result, error) {
+	if previous, ok := secret.Annotations[previousKeyAnnotation]; ok {
+		if wait := rotatedAt(secret).Add(keyGrace).Sub(time.Now()); wait > 0 {
+			log.Info("deferring rotation while the previous deploy key is in use", "id", previous)
+			return ctrl.Result{RequeueAfter: wait}, nil
+		}
+
+		if err := removeKey(ctx, keys, owner, name, previous); err != nil {
+			return resultFor(err)
+		}
+
+		delete(secret.Annotations, previousKeyAnnotation)
+	}
+
+	keyPair, err := githubwebhook.GenerateKey(r.KeyType)
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "couldn't generate ssh key")
+	}
+
+	id, err := keys.add(ctx, owner, name, keyPair.Public)
+	if err != nil {
+		log.Error(err, "unable to add deploy key")
+		return resultFor(err)
+	}
+
+	if current, ok := secret.Annotations[githubwebhook.KeyIDAnnotation]; ok {
+		secret.Annotations[previousKeyAnnotation] = current
+	}
+
+	secret.Annotations[githubwebhook.KeyIDAnnotation] = strconv.FormatInt(id, 10)
+	secret.Annotations[rotatedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	delete(secret.Annotations, rotateAnnotation)
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+
+	secret.Data[identityKey] = keyPair.Private
+
+	if err := r.Update(ctx, secret); err != nil {
+		// Don't leave a key behind we don't know about
+		if err := keys.remove(ctx, owner, name, id); err != nil {
+			log.Error(err, "unable to remove new deploy key", "id", id)
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	log.Info("rotated deploy key", "id", id)
+
+	return ctrl.Result{RequeueAfter: keyGrace}, r.updateCopies(ctx, secret)
+}
+
+// removeKeys removes the keys of a deleted secret from its repo.
+func (r *DeployKeyReconciler) removeKeys(
+	ctx context.Context, log logr.Logger, secret *v1.Secret, keys deployKeys, owner, name string,
+) (ctrl.Result, error) {
+	if !hasFinalizer(secret, removeKeyFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	for _, annotation := range []string{githubwebhook.KeyIDAnnotation, previousKeyAnnotation} {
+		id, ok := secret.Annotations[annotation]
+		if !ok {
+			continue
+		}
+
+		if err := removeKey(ctx, keys, owner, name, id); err != nil {
+			if after := githubwebhook.RetryAfter(err); after > 0 {
+				return ctrl.Result{RequeueAfter: after}, nil
+			}
+
+			// We've most likely lost access already
+			log.Error(err, "unable to remove deploy key", "id", id)
+		}
+	}
+
+	controllerutil.RemoveFinalizer(secret, removeKeyFinalizer)
+
+	return ctrl.Result{}, r.Update(ctx, secret)
+}
+
+// updateCopies gives the flux instances using secret its current key.
+func (r *DeployKeyReconciler) updateCopies(ctx context.Context, secret *v1.Secret) error {
+	refReleases, err := r.usedBy(ctx, secret.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, refRelease := range refReleases {
+		var copied v1.Secret
+
+		nn := types.NamespacedName{Name: fluxDeployKeyName, Namespace: refRelease.Namespace}
+		if err := r.Get(ctx, nn, &copied); err != nil {
+			// The RefRelease controller creates it from the current key
+			if client.IgnoreNotFound(err) != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if bytes.Equal(copied.Data[identityKey], secret.Data[identityKey]) {
+			continue
+		}
+
+		if copied.Data == nil {
+			copied.Data = map[string][]byte{}
+		}
+
+		copied.Data[identityKey] = secret.Data[identityKey]
+
+		if err := r.Update(ctx, &copied); err != nil {
+			return errors.Wrapf(err, "couldn't update deploy key of %s", refRelease.Namespace)
+		}
+	}
+
+	return nil
+}
+
+// usedBy finds the RefReleases using the key secret name.
+func (r *DeployKeyReconciler) usedBy(ctx context.Context, name string) ([]deployv1alpha1.RefRelease, error) {
+	var refReleases deployv1alpha1.RefReleaseList
+	if err := r.List(ctx, &refReleases); err != nil {
+		return nil, err
+	}
+
+	var found []deployv1alpha1.RefRelease
+
+	for _, refRelease := range refReleases.Items {
+		if refRelease.Spec.Repo.KeySecretName == name {
+			found = append(found, refRelease)
+		}
+	}
+
+	return found, nil
+}
+
+// repoOf gives owner/name of the repo of a key secret. Secrets from before
+// we annotated them are only used for their repo's environments.
+func (r *DeployKeyReconciler) repoOf(ctx context.Context, secret *v1.Secret) (string, error) {
+	if repo := secret.Annotations[githubwebhook.KeyRepoAnnotation]; repo != "" {
+		return repo, nil
+	}
+
+	refReleases, err := r.usedBy(ctx, secret.Name)
+	if err != nil || len(refReleases) == 0 {
+		return "", err
+	}
+
+	repo := refReleases[0].Spec.Repo
+
+	return repo.Owner + "/" + repo.Name, nil
+}
+
+// keysFor gives us the deploy keys of the provider of secret.
+func (r *DeployKeyReconciler) keysFor(ctx context.Context, secret *v1.Secret, owner, name string) (deployKeys, error) {
+	if secret.Annotations[githubwebhook.KeyProviderAnnotation] == deployv1alpha1.GitlabProvider {
+		if r.Gitlab == nil {
+			return nil, errors.New("GitLab isn't configured")
+		}
+
+		return &gitlabKeys{r.Gitlab}, nil
+	}
+
+	ghCli, err := r.GhCli(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &githubKeys{ghCli}, nil
+}
+
+// findKey looks for the key of secret on its repo.
+func (r *DeployKeyReconciler) findKey(
+	ctx context.Context, keys deployKeys, secret *v1.Secret, owner, name string,
+) (int64, error) {
+	signer, err := ssh.ParsePrivateKey(secret.Data[identityKey])
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't parse deploy key")
+	}
+
+	return keys.find(ctx, owner, name, signer.PublicKey())
+}
+
+func removeKey(ctx context.Context, keys deployKeys, owner, name, id string) error {
+	parsed, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		// Nothing we could remove
+		return nil
+	}
+
+	return keys.remove(ctx, owner, name, parsed)
+}
+
+// rotatedAt is when the current key of secret was added.
+func rotatedAt(secret *v1.Secret) time.Time {
+	if rotated, err := time.Parse(time.RFC3339, secret.Annotations[rotatedAnnotation]); err == nil {
+		return rotated
+	}
+
+	return secret.CreationTimestamp.Time
+}
+
+// splitRepo splits at the last slash since GitLab owners can be nested groups.
+func splitRepo(repo string) (string, string) {
+	i := strings.LastIndex(repo, "/")
+	if i < 0 {
+		return repo, ""
+	}
+
+	return repo[:i], repo[i+1:]
+}
+
+func hasFinalizer(meta metav1.Object, finalizer string) bool {
+	for _, item := range meta.GetFinalizers() {
+		if item == finalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetupWithManager initializes our controller.
+func (r *DeployKeyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	namespace, err := utils.GetCurrentNamespace()
+	if err != nil {
+		return err
+	}
+
+	isKeySecret := func(meta metav1.Object) bool {
+		if meta.GetNamespace() != namespace {
+			return false
+		}
+
+		_, labeled := meta.GetLabels()[githubwebhook.DeployKeyLabel]
+
+		return labeled || strings.HasPrefix(meta.GetName(), keySecretPrefix)
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("deploykey").
+		For(&v1.Secret{}).
+		WithEventFilter(predicate.Funcs{
+			CreateFunc:  func(e event.CreateEvent) bool { return isKeySecret(e.Meta) },
+			UpdateFunc:  func(e event.UpdateEvent) bool { return isKeySecret(e.MetaNew) },
+			DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+			GenericFunc: func(e event.GenericEvent) bool { return isKeySecret(e.Meta) },
+		}).
+		Complete(r)
+}
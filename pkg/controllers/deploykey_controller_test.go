@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
+)
+
+// memoryKeys are the deploy keys of a single repo.
+type memoryKeys struct {
+	next    int64
+	keys    map[int64]ssh.PublicKey
+	removed []int64
+}
+
+func (k *memoryKeys) add(ctx context.Context, owner, name string, key []byte) (int64, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	k.next++
+	k.keys[k.next] = parsed
+
+	return k.next, nil
+}
+
+func (k *memoryKeys) find(ctx context.Context, owner, name string, key ssh.PublicKey) (int64, error) {
+	for id, found := range k.keys {
+		if sameKey(string(ssh.MarshalAuthorizedKey(found)), key) {
+			return id, nil
+		}
+	}
+
+	return 0, nil
+}
+
+func (k *memoryKeys) remove(ctx context.Context, owner, name string, id int64) error {
+	delete(k.keys, id)
+	k.removed = append(k.removed, id)
+
+	return nil
+}
+
+func TestSameKey(t *testing.T) {
+	first, err := githubwebhook.GenerateKey(githubwebhook.KeyEd25519)
+	assert.NoError(t, err)
+	second, err := githubwebhook.GenerateKey(githubwebhook.KeyRSA)
+	assert.NoError(t, err)
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(first.Public)
+	assert.NoError(t, err)
+
+	line := string(first.Public)
+	assert.True(t, sameKey(line, key))
+	assert.True(t, sameKey(line+" with a comment", key), "comments are ignored")
+	assert.False(t, sameKey(string(second.Public), key))
+	assert.False(t, sameKey("not a key", key))
+}
+
+func TestSplitRepo(t *testing.T) {
+	owner, name := splitRepo("michaelbeaumont/properator")
+	assert.Equal(t, "michaelbeaumont", owner)
+	assert.Equal(t, "properator", name)
+
+	owner, name = splitRepo("group/subgroup/project")
+	assert.Equal(t, "group/subgroup", owner)
+	assert.Equal(t, "project", name)
+
+	owner, name = splitRepo("properator")
+	assert.Equal(t, "properator", owner)
+	assert.Equal(t, "", name)
+}
+
+func TestRotate(t *testing.T) {
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	assert.NoError(t, clientgoscheme.AddToScheme(scheme))
+	assert.NoError(t, deployv1alpha1.AddToScheme(scheme))
+
+	keys := &memoryKeys{next: 1, keys: map[int64]ssh.PublicKey{}}
+	nn := types.NamespacedName{Name: keySecretPrefix + "1", Namespace: "properator"}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      nn.Name,
+			Namespace: nn.Namespace,
+			Annotations: map[string]string{
+				githubwebhook.KeyIDAnnotation: "1",
+				rotatedAnnotation:             time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+			},
+		},
+	}
+
+	r := &DeployKeyReconciler{
+		Client: fake.NewFakeClientWithScheme(scheme, secret.DeepCopy()),
+		Log:    ctrl.Log.WithName("test"),
+		Scheme: scheme,
+	}
+	rotate := func() ctrl.Result {
+		var current v1.Secret
+		assert.NoError(t, r.Get(ctx, nn, &current))
+
+		result, err := r.rotate(ctx, r.Log, &current, keys, "owner", "repo")
+		assert.NoError(t, err)
+
+		secret = &v1.Secret{}
+		assert.NoError(t, r.Get(ctx, nn, secret))
+
+		return result
+	}
+
+	result := rotate()
+	assert.Equal(t, keyGrace, result.RequeueAfter)
+	assert.Equal(t, "2", secret.Annotations[githubwebhook.KeyIDAnnotation])
+	assert.Equal(t, "1", secret.Annotations[previousKeyAnnotation])
+	assert.NotEmpty(t, secret.Data[identityKey])
+	assert.Empty(t, keys.removed)
+
+	found, err := r.findKey(ctx, keys, secret, "owner", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), found, "the secret has the new key")
+
+	// Flux may still be using the previous key
+	secret.Annotations[rotateAnnotation] = ""
+	assert.NoError(t, r.Update(ctx, secret))
+
+	result = rotate()
+	assert.True(t, result.RequeueAfter > 0 && result.RequeueAfter <= keyGrace)
+	assert.Equal(t, "2", secret.Annotations[githubwebhook.KeyIDAnnotation])
+	assert.Equal(t, "1", secret.Annotations[previousKeyAnnotation])
+	assert.Contains(t, secret.Annotations, rotateAnnotation, "the rotation is still requested")
+	assert.Empty(t, keys.removed)
+
+	secret.Annotations[rotatedAnnotation] = time.Now().Add(-keyGrace - time.Minute).UTC().Format(time.RFC3339)
+	assert.NoError(t, r.Update(ctx, secret))
+
+	rotate()
+	assert.Equal(t, "3", secret.Annotations[githubwebhook.KeyIDAnnotation])
+	assert.Equal(t, "2", secret.Annotations[previousKeyAnnotation])
+	assert.NotContains(t, secret.Annotations, rotateAnnotation)
+	assert.Equal(t, []int64{1}, keys.removed)
+}
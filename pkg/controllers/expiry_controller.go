@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	gh "github.com/google/go-github/v31/github"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+)
+
+// +kubebuilder:rbac:groups=deploy.properator.io,resources=refreleases,verbs=get;list;watch;update
+// +kubebuilder:rbac:groups=deploy.properator.io,resources=githubdeployments,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch;delete
+
+// ExpiryReconciler drops environments once they pass their TTL or have been
+// idle for too long, warning their PR beforehand.
+type ExpiryReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	GhCli  ClientForOwnerRepo
+	// Gitlab is only needed for environments on GitLab
+	Gitlab *gitlab.Client
+	// Username is who to mention for commands on GitHub
+	Username string
+	// Warning is how long before an environment expires its PR is told
+	Warning time.Duration
+}
+
+// Reconcile handles RefReleases with an expiry.
+func (r *ExpiryReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("refrelease", req.NamespacedName)
+
+	var refRelease deployv1alpha1.RefRelease
+	if err := r.Get(ctx, req.NamespacedName, &refRelease); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if refRelease.Spec.Expiry == nil || !refRelease.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	now := time.Now()
+
+	// New commits keep idle environments around
+	if sha := refRelease.Spec.Ref.Sha; refRelease.Status.Sha != sha {
+		updated := metav1.NewTime(now)
+		refRelease.Status.Sha = sha
+		refRelease.Status.UpdatedAt = &updated
+
+		return ctrl.Result{}, r.Update(ctx, &refRelease)
+	}
+
+	expires, ok := refRelease.ExpiresAt()
+	if !ok {
+		return ctrl.Result{}, nil
+	}
+
+	if !now.Before(expires) {
+		return r.drop(ctx, log, &refRelease)
+	}
+
+	warnAt := expires.Add(-r.Warning)
+	if now.Before(warnAt) {
+		return ctrl.Result{RequeueAfter: warnAt.Sub(now)}, nil
+	}
+
+	// Expiries are only stored to the second
+	if warned := refRelease.Status.Warned; warned != nil && warned.Unix() == expires.Unix() {
+		return ctrl.Result{RequeueAfter: expires.Sub(now)}, nil
+	}
+
+	body := fmt.Sprintf(
+		":hourglass: This environment expires at %s. Comment `%%s extend` to keep it.",
+		expires.UTC().Format(time.RFC1123),
+	)
+	if err := r.comment(ctx, &refRelease, body); err != nil {
+		log.Error(err, "unable to warn about expiry")
+		return resultFor(err)
+	}
+
+	warned := metav1.NewTime(expires)
+	refRelease.Status.Warned = &warned
+
+	if err := r.Update(ctx, &refRelease); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	log.Info("warned about expiry", "expires", expires)
+
+	return ctrl.Result{RequeueAfter: expires.Sub(now)}, nil
+}
+
+// drop deletes the namespace of an expired environment.
+func (r *ExpiryReconciler) drop(
+	ctx context.Context, log logr.Logger, refRelease *deployv1alpha1.RefRelease,
+) (ctrl.Result, error) {
+	var ns v1.Namespace
+	if err := r.Get(ctx, types.NamespacedName{Name: refRelease.Namespace}, &ns); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if _, ok := ns.Annotations[githubwebhook.EnvironmentAnnotation]; !ok {
+		log.Info("not dropping expired environment in a namespace we don't own")
+		return ctrl.Result{}, nil
+	}
+
+	if !ns.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.Delete(ctx, &ns); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log.Info("dropped expired environment")
+
+	body := ":wastebasket: This environment expired and was dropped. Comment `%s deploy` to deploy it again."
+	if err := r.comment(ctx, refRelease, body); err != nil {
+		// The environment is gone either way
+		log.Error(err, "unable to tell PR about dropped environment")
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// comment posts on the PR of refRelease, with %s in format replaced by the
+// mention commands start with.
+func (r *ExpiryReconciler) comment(ctx context.Context, refRelease *deployv1alpha1.RefRelease, format string) error {
+	repo, number := refRelease.Spec.Repo, refRelease.Spec.Ref.PullRequest
+
+	// The GithubDeployment knows which provider the PR is on
+	var gd deployv1alpha1.GithubDeployment
+	nn := types.NamespacedName{Name: refRelease.Name, Namespace: refRelease.Namespace}
+	if err := r.Get(ctx, nn, &gd); client.IgnoreNotFound(err) != nil {
+		return err
+	}
+
+	if gd.Spec.Provider == deployv1alpha1.GitlabProvider {
+		if r.Gitlab == nil {
+			return errors.New("GitLab isn't configured")
+		}
+
+		user, err := r.Gitlab.CurrentUser(ctx)
+		if err != nil {
+			return err
+		}
+
+		body := fmt.Sprintf(format, "@"+user.Username)
+		_, err = r.Gitlab.CreateNote(ctx, gitlab.Project(repo.Owner+"/"+repo.Name), number, body)
+
+		return err
+	}
+
+	cli, err := r.GhCli(ctx, repo.Owner, repo.Name)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(format, "@"+r.Username)
+	_, _, err = cli.Issues.CreateComment(ctx, repo.Owner, repo.Name, number, &gh.IssueComment{Body: &body})
+
+	return err
+}
+
+// SetupWithManager initializes our controller.
+func (r *ExpiryReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("expiry").
+		For(&deployv1alpha1.RefRelease{}).
+		Complete(r)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
@@ -19,13 +20,58 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
 	"github.com/michaelbeaumont/properator/pkg/utils"
 )
 
 const (
 	fluxDeployKeyName = "properator-git-deploy-key"
+	knownHostsKey     = "known_hosts"
+	// fluxCredentialsName holds the installation token flux clones with
+	fluxCredentialsName = "properator-git-credentials"
+	gitTokenKey         = "GIT_AUTHKEY"
+	// fluxSecretValue and credentialsSecretValue are the SecretLabel of
+	// the secrets of flux
+	fluxSecretValue        = "flux"
+	credentialsSecretValue = "git-credentials"
+	// credentialsPath is where flux finds fluxCredentialsName
+	credentialsPath = "/etc/fluxd/credentials"
+	// gitConfigKey in the ConfigMap of flux is its git config
+	gitConfigKey = "gitconfig"
+	fluxImage    = "docker.io/fluxcd/flux:1.19.0"
+	// pinnedPath holds the repo flux clones from when it's pinned
+	pinnedPath = "/var/properator/git"
 )
 
+// gitConfig has git read the token from the mounted credentials every time
+// it needs one, so new tokens are picked up without restarting flux.
+var gitConfig = fmt.Sprintf(`[credential]
+	helper = "!f() { echo password=$(cat %s/%s); }; f"
+`, credentialsPath, gitTokenKey)
+
+// pinScript keeps a branch of the bare repo in pinnedPath at the sha in the
+// ConfigMap, fetching it from GIT_URL. Pushes to the branch only reach flux
+// once the sha is updated. Given `once`, it only syncs once.
+var pinScript = fmt.Sprintf(`set -u
+repo=%s/repo.git
+[ -d "$repo" ] || git init --quiet --bare "$repo"
+sync() {
+	sha=$(cat /etc/properator/sha)
+	if ! git -C "$repo" cat-file -e "$sha^{commit}" 2>/dev/null; then
+		git -C "$repo" fetch --quiet "$GIT_URL" "$GIT_BRANCH"
+		git -C "$repo" cat-file -e "$sha^{commit}" 2>/dev/null || git -C "$repo" fetch --quiet "$GIT_URL" "$sha"
+	fi
+	git -C "$repo" update-ref "refs/heads/$GIT_BRANCH" "$sha"
+}
+if [ "${1:-}" = once ]; then
+	sync
+	exit
+fi
+while sleep 30; do
+	sync || echo "couldn't sync $sha" >&2
+done
+`, pinnedPath)
+
 // Flux holds all k8s resources needed for flux.
 type Flux struct {
 	deployment     appsv1.Deployment
@@ -71,11 +117,20 @@ func (f *Flux) Deploy(ctx context.Context, log logr.Logger, c client.Client, r c
 // FluxResources creates the k8s resources needed to launch flux.
 func FluxResources(
 	ctx context.Context, r client.Reader, meta metav1.ObjectMeta, spec deployv1alpha1.RefReleaseSpec,
+	github githubwebhook.Endpoints,
 ) (Flux, error) {
 	repo := spec.Repo
 	ref := spec.Ref
-	fullName := fmt.Sprintf("%s/%s", repo.Owner, repo.Name)
-	repoURL := fmt.Sprintf("git@github.com:%[1]s", fullName)
+	tokenAuth := repo.Auth == deployv1alpha1.TokenAuth
+	repoURL := repo.URL
+	switch {
+	case tokenAuth && repoURL == "":
+		repoURL = withCredentials(github.HTTPSURL(repo.Owner, repo.Name))
+	case tokenAuth:
+		repoURL = withCredentials(repoURL)
+	case repoURL == "":
+		repoURL = github.GitURL(repo.Owner, repo.Name)
+	}
 
 	var refStr string
 	if ref.Branch != "" {
@@ -91,6 +146,12 @@ func FluxResources(
 	if ref.PullRequest != 0 {
 		data["pr"] = strconv.Itoa(ref.PullRequest)
 	}
+	if github.KnownHosts != "" {
+		data[knownHostsKey] = github.KnownHosts
+	}
+	if tokenAuth {
+		data[gitConfigKey] = gitConfig
+	}
 
 	configMap := v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
@@ -99,7 +160,10 @@ func FluxResources(
 		},
 		Data: data,
 	}
-	deployment := fluxDeployment(meta, repoURL, ref.Branch)
+	deployment := fluxDeployment(meta, repoURL, ref.Branch, spec.Path, github.KnownHosts != "", tokenAuth)
+	if ref.Pinned {
+		pin(&deployment, repoURL, ref.Branch, github.KnownHosts != "")
+	}
 	sa, rb := fluxRbac(meta)
 
 	secret, err := fluxSecret(ctx, r, repo.KeySecretName, meta.Namespace)
@@ -116,6 +180,11 @@ func FluxResources(
 	}, nil
 }
 
+// fluxSecretLabels has the manager watch the git secret of flux.
+func fluxSecretLabels() map[string]string {
+	return map[string]string{githubwebhook.SecretLabel: fluxSecretValue}
+}
+
 func fluxSecret(
 	ctx context.Context, r client.Reader, keySecretName string, refNamespace string,
 ) (v1.Secret, error) {
@@ -124,6 +193,16 @@ func fluxSecret(
 		return v1.Secret{}, err
 	}
 
+	// flux doesn't need a key for HTTPS but insists on its secret
+	if keySecretName == "" {
+		return v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: fluxDeployKeyName, Namespace: refNamespace, Labels: fluxSecretLabels(),
+			},
+			Type: v1.SecretTypeOpaque,
+		}, nil
+	}
+
 	nn := types.NamespacedName{Name: keySecretName, Namespace: namespace}
 
 	var commonSecret v1.Secret
@@ -133,19 +212,75 @@ func fluxSecret(
 
 	return v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: fluxDeployKeyName, Namespace: refNamespace,
+			Name: fluxDeployKeyName, Namespace: refNamespace, Labels: fluxSecretLabels(),
 		},
 		Data: commonSecret.Data,
 		Type: commonSecret.Type,
 	}, nil
 }
 
-func fluxContainer(namespace, repo, ref string) v1.Container {
+// withCredentials has git authenticate as gitTokenUser on an HTTPS URL, the
+// credential helper of gitConfig gives it the token.
+func withCredentials(repoURL string) string {
+	return strings.Replace(repoURL, "://", "://"+gitTokenUser+"@", 1)
+}
+
+func fluxContainer(namespace, repo, ref, path string, knownHosts, credentials bool) v1.Container {
 	var port, probeSeconds int32 = 3030, 5
 
+	args := []string{
+		fmt.Sprintf("--git-url=%s", repo),
+		fmt.Sprintf("--git-branch=%s", ref),
+		"--git-label=flux",
+		"--git-readonly",
+		"--sync-garbage-collection",
+		fmt.Sprintf("--k8s-secret-name=%s", fluxDeployKeyName),
+		"--registry-disable-scanning",
+		fmt.Sprintf("--k8s-default-namespace=%s", namespace),
+		"--manifest-generation=true",
+	}
+	if path != "" {
+		args = append(args, fmt.Sprintf("--git-path=%s", path))
+	}
+
+	mounts := []v1.VolumeMount{
+		{
+			Name:      "git-key",
+			MountPath: "/etc/fluxd/ssh",
+		},
+		{
+			Name:      "properator",
+			MountPath: "/etc/properator",
+		},
+	}
+	// Replaces the host keys flux ships with
+	if knownHosts {
+		mounts = append(mounts, v1.VolumeMount{
+			Name:      "properator",
+			MountPath: "/root/.ssh/known_hosts",
+			SubPath:   knownHostsKey,
+		})
+	}
+
+	if credentials {
+		mounts = append(mounts,
+			v1.VolumeMount{
+				Name:      "properator",
+				MountPath: "/root/.gitconfig",
+				SubPath:   gitConfigKey,
+			},
+			// Not a subPath so that new tokens show up
+			v1.VolumeMount{
+				Name:      "git-credentials",
+				MountPath: credentialsPath,
+				ReadOnly:  true,
+			},
+		)
+	}
+
 	return v1.Container{
 		Name:  "flux",
-		Image: "docker.io/fluxcd/flux:1.19.0",
+		Image: fluxImage,
 		Resources: v1.ResourceRequirements{
 			Requests: v1.ResourceList{
 				v1.ResourceCPU:    resource.MustParse("50m"),
@@ -177,34 +312,54 @@ func fluxContainer(namespace, repo, ref string) v1.Container {
 			InitialDelaySeconds: probeSeconds,
 			TimeoutSeconds:      probeSeconds,
 		},
-		VolumeMounts: []v1.VolumeMount{
-			{
-				Name:      "git-key",
-				MountPath: "/etc/fluxd/ssh",
-			},
-			{
-				Name:      "properator",
-				MountPath: "/etc/properator",
-			},
-		},
-		Args: []string{
-			fmt.Sprintf("--git-url=%s", repo),
-			fmt.Sprintf("--git-branch=%s", ref),
-			//# - --git-path=subdir1,subdir2
-			"--git-label=flux",
-			"--git-readonly",
-			"--sync-garbage-collection",
-			fmt.Sprintf("--k8s-secret-name=%s", fluxDeployKeyName),
-			"--registry-disable-scanning",
-			fmt.Sprintf("--k8s-default-namespace=%s", namespace),
-			"--manifest-generation=true",
-		},
+		VolumeMounts: mounts,
+		Args:         args,
 	}
 }
 
-func fluxDeployment(meta metav1.ObjectMeta, repo, ref string) appsv1.Deployment {
+func fluxDeployment(meta metav1.ObjectMeta, repo, ref, path string, knownHosts, credentials bool) appsv1.Deployment {
 	var keyFileMode int32 = 0400
 
+	annotations := map[string]string{
+		"prometheus.io/port": "3031",
+	}
+	if restartedAt, ok := meta.Annotations[deployv1alpha1.RestartedAtAnnotation]; ok {
+		annotations[deployv1alpha1.RestartedAtAnnotation] = restartedAt
+	}
+
+	volumes := []v1.Volume{
+		{
+			Name: "git-key",
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{
+					SecretName:  fluxDeployKeyName,
+					DefaultMode: &keyFileMode,
+				},
+			},
+		},
+		{
+			Name: "properator",
+			VolumeSource: v1.VolumeSource{
+				ConfigMap: &v1.ConfigMapVolumeSource{
+					LocalObjectReference: v1.LocalObjectReference{
+						Name: meta.Name,
+					},
+				},
+			},
+		},
+	}
+	if credentials {
+		volumes = append(volumes, v1.Volume{
+			Name: "git-credentials",
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{
+					SecretName:  fluxCredentialsName,
+					DefaultMode: &keyFileMode,
+				},
+			},
+		})
+	}
+
 	return appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      meta.Name,
@@ -224,35 +379,13 @@ func fluxDeployment(meta metav1.ObjectMeta, repo, ref string) appsv1.Deployment
 					Labels: map[string]string{
 						"name": meta.Name,
 					},
-					Annotations: map[string]string{
-						"prometheus.io/port": "3031",
-					},
+					Annotations: annotations,
 				},
 				Spec: v1.PodSpec{
 					ServiceAccountName: meta.Name,
-					Volumes: []v1.Volume{
-						{
-							Name: "git-key",
-							VolumeSource: v1.VolumeSource{
-								Secret: &v1.SecretVolumeSource{
-									SecretName:  fluxDeployKeyName,
-									DefaultMode: &keyFileMode,
-								},
-							},
-						},
-						{
-							Name: "properator",
-							VolumeSource: v1.VolumeSource{
-								ConfigMap: &v1.ConfigMapVolumeSource{
-									LocalObjectReference: v1.LocalObjectReference{
-										Name: meta.Name,
-									},
-								},
-							},
-						},
-					},
+					Volumes:            volumes,
 					Containers: []v1.Container{
-						fluxContainer(meta.Namespace, repo, ref),
+						fluxContainer(meta.Namespace, repo, ref, path, knownHosts, credentials),
 					},
 				},
 			},
@@ -260,6 +393,62 @@ func fluxDeployment(meta metav1.ObjectMeta, repo, ref string) appsv1.Deployment
 	}
 }
 
+// pin has flux clone from a repo in the pod, where a branch is kept at the sha
+// in the ConfigMap, instead of from repoURL.
+func pin(deployment *appsv1.Deployment, repoURL, branch string, knownHosts bool) {
+	pod := &deployment.Spec.Template.Spec
+	pod.Volumes = append(pod.Volumes, v1.Volume{
+		Name:         "pinned",
+		VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}},
+	})
+
+	mount := v1.VolumeMount{Name: "pinned", MountPath: pinnedPath}
+	flux := &pod.Containers[0]
+	flux.VolumeMounts = append(flux.VolumeMounts, mount)
+
+	for i, arg := range flux.Args {
+		if strings.HasPrefix(arg, "--git-url=") {
+			flux.Args[i] = fmt.Sprintf("--git-url=file://%s/repo.git", pinnedPath)
+		}
+	}
+
+	// Uses the same key and host keys as flux would
+	mounts := []v1.VolumeMount{
+		mount,
+		{Name: "git-key", MountPath: "/etc/fluxd/ssh"},
+		{Name: "properator", MountPath: "/etc/properator"},
+	}
+	if knownHosts {
+		mounts = append(mounts, v1.VolumeMount{
+			Name:      "properator",
+			MountPath: "/root/.ssh/known_hosts",
+			SubPath:   knownHostsKey,
+		})
+	}
+
+	container := func(name string, args ...string) v1.Container {
+		return v1.Container{
+			Name:    name,
+			Image:   fluxImage,
+			Command: append([]string{"/bin/sh", "-c", pinScript, "pin"}, args...),
+			Env: []v1.EnvVar{
+				{Name: "GIT_URL", Value: repoURL},
+				{Name: "GIT_BRANCH", Value: branch},
+			},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceCPU:    resource.MustParse("10m"),
+					v1.ResourceMemory: resource.MustParse("16Mi"),
+				},
+			},
+			VolumeMounts: mounts,
+		}
+	}
+	// flux only starts once the approved commit is there
+	pod.InitContainers = append(pod.InitContainers, container("pin-init", "once"))
+	pod.Containers = append(pod.Containers, container("pin"))
+}
+
 func fluxRbac(meta metav1.ObjectMeta) (v1.ServiceAccount, rbacv1.RoleBinding) {
 	sa := v1.ServiceAccount{
 		ObjectMeta: metav1.ObjectMeta{Name: meta.Name, Namespace: meta.Namespace},
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
+	"github.com/michaelbeaumont/properator/pkg/utils"
+)
+
+func TestWithCredentials(t *testing.T) {
+	assert.Equal(t,
+		"https://x-access-token@github.com/owner/repo.git",
+		withCredentials("https://github.com/owner/repo.git"),
+	)
+	assert.Equal(t,
+		"https://x-access-token@github.example.com:8443/owner/repo.git",
+		withCredentials("https://github.example.com:8443/owner/repo.git"),
+	)
+}
+
+func TestFluxResourcesTokenAuth(t *testing.T) {
+	os.Setenv(utils.NamespaceEnv, "properator")
+	defer os.Unsetenv(utils.NamespaceEnv)
+
+	meta := metav1.ObjectMeta{Name: "github-webhook", Namespace: "properator-github-webhook-1-2"}
+	spec := deployv1alpha1.RefReleaseSpec{
+		Repo: deployv1alpha1.Repo{Owner: "owner", Name: "repo", Auth: deployv1alpha1.TokenAuth},
+		Ref:  deployv1alpha1.Ref{Branch: "feature", Sha: "abc", PullRequest: 2},
+	}
+
+	flux, err := FluxResources(context.Background(), fake.NewFakeClient(), meta, spec, githubwebhook.Endpoints{})
+	assert.NoError(t, err)
+
+	container := flux.deployment.Spec.Template.Spec.Containers[0]
+	assert.Contains(t, container.Args, "--git-url=https://x-access-token@github.com/owner/repo.git")
+	assert.Empty(t, container.Env, "credentials aren't read from the environment")
+	assert.Contains(t, container.VolumeMounts, v1.VolumeMount{
+		Name: "properator", MountPath: "/root/.gitconfig", SubPath: gitConfigKey,
+	})
+	assert.Contains(t, container.VolumeMounts, v1.VolumeMount{
+		Name: "git-credentials", MountPath: credentialsPath, ReadOnly: true,
+	})
+
+	var credentials *v1.SecretVolumeSource
+	for _, volume := range flux.deployment.Spec.Template.Spec.Volumes {
+		if volume.Name == "git-credentials" {
+			credentials = volume.Secret
+		}
+	}
+	if assert.NotNil(t, credentials) {
+		assert.Equal(t, fluxCredentialsName, credentials.SecretName)
+	}
+
+	assert.Equal(t, gitConfig, flux.configMap.Data[gitConfigKey])
+	assert.Contains(t, gitConfig, credentialsPath+"/"+gitTokenKey)
+	assert.Empty(t, flux.secret.Data, "no deploy key is needed")
+
+	spec.Repo.Auth = ""
+	spec.Repo.KeySecretName = "properator-git-deploy-key-1"
+	key := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: spec.Repo.KeySecretName, Namespace: "properator"},
+		Data:       map[string][]byte{identityKey: []byte("key")},
+	}
+
+	flux, err = FluxResources(context.Background(), fake.NewFakeClient(key), meta, spec, githubwebhook.Endpoints{})
+	assert.NoError(t, err)
+
+	container = flux.deployment.Spec.Template.Spec.Containers[0]
+	assert.Contains(t, container.Args, "--git-url=git@github.com:owner/repo")
+	assert.Len(t, flux.deployment.Spec.Template.Spec.Volumes, 2)
+	assert.NotContains(t, flux.configMap.Data, gitConfigKey)
+	assert.Equal(t, []byte("key"), flux.secret.Data[identityKey])
+}
+
+func TestFluxResourcesPinned(t *testing.T) {
+	os.Setenv(utils.NamespaceEnv, "properator")
+	defer os.Unsetenv(utils.NamespaceEnv)
+
+	meta := metav1.ObjectMeta{Name: "github-webhook", Namespace: "properator-github-webhook-1-2"}
+	spec := deployv1alpha1.RefReleaseSpec{
+		Repo: deployv1alpha1.Repo{Owner: "owner", Name: "repo", URL: "https://github.com/fork/repo.git"},
+		Ref:  deployv1alpha1.Ref{Branch: "feature", Sha: "abc", PullRequest: 2, Pinned: true},
+	}
+
+	flux, err := FluxResources(context.Background(), fake.NewFakeClient(), meta, spec, githubwebhook.Endpoints{})
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", flux.configMap.Data["sha"])
+
+	pod := flux.deployment.Spec.Template.Spec
+	assert.Contains(t, pod.Containers[0].Args, "--git-url=file://"+pinnedPath+"/repo.git", "flux never sees the fork")
+	assert.Contains(t, pod.Containers[0].Args, "--git-branch=feature")
+	assert.Contains(t, pod.Containers[0].VolumeMounts, v1.VolumeMount{Name: "pinned", MountPath: pinnedPath})
+
+	if assert.Len(t, pod.InitContainers, 1) && assert.Len(t, pod.Containers, 2) {
+		for _, pin := range []v1.Container{pod.InitContainers[0], pod.Containers[1]} {
+			assert.Contains(t, pin.Env, v1.EnvVar{Name: "GIT_URL", Value: "https://github.com/fork/repo.git"})
+			assert.Contains(t, pin.Env, v1.EnvVar{Name: "GIT_BRANCH", Value: "feature"})
+		}
+		assert.Equal(t, "once", pod.InitContainers[0].Command[len(pod.InitContainers[0].Command)-1])
+	}
+
+	spec.Ref.Pinned = false
+	flux, err = FluxResources(context.Background(), fake.NewFakeClient(), meta, spec, githubwebhook.Endpoints{})
+	assert.NoError(t, err)
+	assert.Contains(t, flux.deployment.Spec.Template.Spec.Containers[0].Args, "--git-url=https://github.com/fork/repo.git")
+	assert.Len(t, flux.deployment.Spec.Template.Spec.Containers, 1)
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+)
+
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=deploy.properator.io,resources=githubdeployments,verbs=get;list;watch;create;update;patch;delete
+
+// fluxSyncAnnotation is where flux, when it can't write to the repo,
+// records the last commit it synced on its git secret.
+const fluxSyncAnnotation = "flux.weave.works/sync-hwm"
+
+// FluxSyncReconciler tells the GithubDeployment of a RefRelease which commit
+// flux has synced.
+type FluxSyncReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+// Reconcile handles flux git secrets.
+func (r *FluxSyncReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("secret", req.NamespacedName)
+
+	var secret v1.Secret
+	if err := r.Get(ctx, req.NamespacedName, &secret); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	sha, ok := secret.Annotations[fluxSyncAnnotation]
+	if !ok {
+		return ctrl.Result{}, nil
+	}
+
+	owner := metav1.GetControllerOf(&secret)
+	if owner == nil || owner.Kind != "RefRelease" {
+		return ctrl.Result{}, nil
+	}
+
+	// The webhook names the GithubDeployment after the RefRelease
+	nn := client.ObjectKey{Name: owner.Name, Namespace: secret.Namespace}
+
+	var gd deployv1alpha1.GithubDeployment
+	if err := r.Get(ctx, nn, &gd); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Flux may still report a commit we've since moved on from
+	if gd.Spec.Sha == sha {
+		return ctrl.Result{}, nil
+	}
+
+	for _, dep := range gd.Status.History {
+		if dep.Sha == sha {
+			return ctrl.Result{}, nil
+		}
+	}
+
+	log.Info("flux synced new commit", "sha", sha)
+	gd.Spec.Sha = sha
+
+	if err := r.Update(ctx, &gd); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func isFluxSecret(meta metav1.Object) bool {
+	return meta.GetName() == fluxDeployKeyName
+}
+
+// SetupWithManager initializes our controller.
+func (r *FluxSyncReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1.Secret{}).
+		WithEventFilter(predicate.Funcs{
+			CreateFunc:  func(e event.CreateEvent) bool { return isFluxSecret(e.Meta) },
+			UpdateFunc:  func(e event.UpdateEvent) bool { return isFluxSecret(e.MetaNew) },
+			DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+			GenericFunc: func(e event.GenericEvent) bool { return isFluxSecret(e.Meta) },
+		}).
+		Complete(r)
+}
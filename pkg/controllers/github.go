@@ -5,19 +5,27 @@ import (
 
 	gh "github.com/google/go-github/v31/github"
 	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
+	ctrl "sigs.k8s.io/controller-runtime"
 )
 
 // ClientForOwnerRepo gives us a gh client for a specific installation.
 type ClientForOwnerRepo func(ctx context.Context, owner, repo string) (*gh.Client, error)
 
+// TokenForRepo creates an installation token that can read a repo.
+type TokenForRepo func(ctx context.Context, owner, repo string) (*gh.InstallationToken, error)
+
 // ClientForOwnerRepoFromSetup gives us a ClientForOwnerRepo functions.
+// Installations and their clients are cached.
 func ClientForOwnerRepoFromSetup(ghCliSetup githubwebhook.GhCliSetup) ClientForOwnerRepo {
-	return func(ctx context.Context, owner, repo string) (*gh.Client, error) {
-		inst, _, err := ghCliSetup.CliForApp.Apps.FindRepositoryInstallation(ctx, owner, repo)
-		if err != nil {
-			return nil, err
-		}
+	return ghCliSetup.Clients.ForRepo
+}
 
-		return ghCliSetup.CliForInstall(inst.GetID())
+// resultFor requeues after the delay GitHub asks for if err is a rate limit.
+// Other errors are requeued with the usual backoff.
+func resultFor(err error) (ctrl.Result, error) {
+	if after := githubwebhook.RetryAfter(err); after > 0 {
+		return ctrl.Result{RequeueAfter: after}, nil
 	}
+
+	return ctrl.Result{}, err
 }
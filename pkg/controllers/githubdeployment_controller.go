@@ -2,11 +2,11 @@ package controllers
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/go-logr/logr"
-	gh "github.com/google/go-github/v31/github"
 	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"github.com/pkg/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -22,15 +22,17 @@ type GithubDeploymentReconciler struct {
 	Log    logr.Logger
 	Scheme *runtime.Scheme
 	GhCli  ClientForOwnerRepo
+	// Gitlab is only needed for deployments on GitLab
+	Gitlab *gitlab.Client
 }
 
 // GithubDeploymentReconciliation is the environment for a specific
 // reconciliation.
 type GithubDeploymentReconciliation struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
-	GhCli  *gh.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Deployer Deployer
 }
 
 var (
@@ -38,42 +40,27 @@ var (
 	autoMerge            = false
 	baseEnvironment      = "properator"
 	inactive             = "inactive"
-	inactiveStatus       = gh.DeploymentStatusRequest{
-		State: &inactive,
-	}
 )
 
-func createStatus(
-	ctx context.Context, ghCli *gh.Client, gd *deployv1alpha1.GithubDeployment, status *gh.DeploymentStatusRequest,
-) error {
-	_, _, err := ghCli.Repositories.CreateDeploymentStatus(
-		ctx, gd.Spec.Owner, gd.Spec.Name, gd.Spec.ID, status,
-	)
-
-	return err
-}
-
 //ReconcileStatus handles telling Github about the status.
 func ReconcileStatus(
-	ctx context.Context, ghCli *gh.Client, gd *deployv1alpha1.GithubDeployment,
+	ctx context.Context, deployer Deployer, gd *deployv1alpha1.GithubDeployment,
 ) (bool, error) {
-	st := &gd.Status
+	st := &gd.Status.DeploymentStatus
 	sp := &gd.Spec
 
 	if sp.Status != *st {
-		*st = sp.Status
-		status := gh.DeploymentStatusRequest{
-			State: &st.State,
-		}
-
-		if st.URL != "" {
-			status.EnvironmentURL = &st.URL
+		state, url := sp.Status.State, sp.Status.URL
+
+		// Only record the status once Github knows about it
+		// so we try again if it doesn't
+		if state != "" {
+			if err := deployer.CreateStatus(ctx, gd, sp.ID, state, url); err != nil {
+				return false, err
+			}
 		}
 
-		// TODO retry on certain GH errors?
-		if *status.State != "" {
-			return true, createStatus(ctx, ghCli, gd, &status)
-		}
+		*st = sp.Status
 
 		return true, nil
 	}
@@ -81,23 +68,58 @@ func ReconcileStatus(
 	return false, nil
 }
 
-func (r *GithubDeploymentReconciliation) createDeployment(
-	ctx context.Context, gd *deployv1alpha1.GithubDeployment,
-) (*gh.Deployment, error) {
-	environment := fmt.Sprintf("%s (%s)", baseEnvironment, gd.Spec.Ref)
-	depReq := gh.DeploymentRequest{
-		Ref:                  &gd.Spec.Ref,
-		Environment:          &environment,
-		AutoMerge:            &autoMerge,
-		TransientEnvironment: &transientEnvironment,
+// maxHistory is how many deployments we remember.
+const maxHistory = 20
+
+// needsDeployment tells us whether Github has a deployment for our Sha.
+func needsDeployment(gd *deployv1alpha1.GithubDeployment) bool {
+	if gd.Spec.ID == 0 {
+		return true
 	}
-	dep, _, err := r.GhCli.Repositories.CreateDeployment(ctx, gd.Spec.Owner, gd.Spec.Name, &depReq)
 
-	if err != nil {
-		return nil, err
+	history := gd.Status.History
+
+	return gd.Spec.Sha != "" && (len(history) == 0 || history[len(history)-1].Sha != gd.Spec.Sha)
+}
+
+// seedHistory records a deployment from before we kept a history, so it isn't
+// taken as outdated. Its Spec.Sha is the commit it was created for.
+func seedHistory(gd *deployv1alpha1.GithubDeployment) bool {
+	if gd.Spec.ID == 0 || len(gd.Status.History) > 0 {
+		return false
+	}
+
+	gd.Status.History = []deployv1alpha1.DeploymentRecord{{ID: gd.Spec.ID, Sha: gd.Spec.Sha}}
+
+	return true
+}
+
+// recordDeployment makes dep our current deployment
+// and returns the previous one, if any.
+func recordDeployment(gd *deployv1alpha1.GithubDeployment, id int64, sha string) int64 {
+	previous := gd.Spec.ID
+	if history := gd.Status.History; len(history) > 0 {
+		previous = history[len(history)-1].ID
+	}
+
+	gd.Spec.ID = id
+	gd.Spec.Sha = sha
+	gd.Status.History = append(gd.Status.History, deployv1alpha1.DeploymentRecord{
+		ID: id, Sha: sha,
+	})
+
+	if len(gd.Status.History) > maxHistory {
+		gd.Status.History = gd.Status.History[len(gd.Status.History)-maxHistory:]
 	}
 
-	return dep, nil
+	// Tell the new deployment about our status
+	gd.Status.DeploymentStatus = deployv1alpha1.DeploymentStatus{}
+
+	if previous == gd.Spec.ID {
+		return 0
+	}
+
+	return previous
 }
 
 const deactivateFinalizer string = "finalizers.deploy.properator.io/deactivate"
@@ -141,11 +163,8 @@ func (r *GithubDeploymentReconciliation) handleBeingDeleted(
 	ctx context.Context, gd *deployv1alpha1.GithubDeployment,
 ) (ctrl.Result, error) {
 	if dropFinalizer(gd) {
-		status := gh.DeploymentStatusRequest{
-			State: &inactive,
-		}
-		if err := createStatus(ctx, r.GhCli, gd, &status); err != nil {
-			return ctrl.Result{}, err
+		if err := r.Deployer.CreateStatus(ctx, gd, gd.Spec.ID, inactive, ""); err != nil {
+			return resultFor(err)
 		}
 
 		if err := r.Update(ctx, gd); err != nil {
@@ -160,30 +179,42 @@ func (r *GithubDeploymentReconciliation) handleBeingDeleted(
 func (r *GithubDeploymentReconciliation) reconcileDeployment(
 	ctx context.Context, gd *deployv1alpha1.GithubDeployment,
 ) (ctrl.Result, error) {
-	if gd.Spec.ID == 0 {
-		var dep *gh.Deployment
-		dep, err := r.createDeployment(ctx, gd)
+	if !gd.ObjectMeta.DeletionTimestamp.IsZero() {
+		return r.handleBeingDeleted(ctx, gd)
+	}
+
+	needsUpdate := ensureFinalizer(gd)
+	needsUpdate = seedHistory(gd) || needsUpdate
+
+	if needsDeployment(gd) {
+		id, sha, err := r.Deployer.CreateDeployment(ctx, gd)
 		// Now handle potentially updated status
 
 		if err != nil {
 			r.Log.Error(err, "unable to create deployment on github")
-		} else {
-			// If flux has updated, we have a successful new dep
-			// we always have an active one
-			gd.Spec.ID = dep.GetID()
-			gd.Spec.Sha = dep.GetSHA()
+
+			// The status belongs to the deployment we couldn't create
+			if needsUpdate {
+				if err := r.Update(ctx, gd); err != nil {
+					r.Log.Error(err, "unable to update github deployment resource")
+				}
+			}
+
+			return resultFor(err)
 		}
-	}
 
-	var needsUpdate bool
+		// A new sha has been pushed or synced by flux
+		// so the previous deployment is outdated
+		needsUpdate = true
 
-	if !gd.ObjectMeta.DeletionTimestamp.IsZero() {
-		return r.handleBeingDeleted(ctx, gd)
+		if previous := recordDeployment(gd, id, sha); previous != 0 {
+			if err := r.Deployer.CreateStatus(ctx, gd, previous, inactive, ""); err != nil {
+				r.Log.Error(err, "unable to deactivate previous deployment", "deployment", previous)
+			}
+		}
 	}
 
-	needsUpdate = ensureFinalizer(gd)
-
-	statusUpdated, err := ReconcileStatus(ctx, r.GhCli, gd)
+	statusUpdated, err := ReconcileStatus(ctx, r.Deployer, gd)
 	if err != nil {
 		r.Log.Error(err, "unable to update on github")
 	}
@@ -196,7 +227,7 @@ func (r *GithubDeploymentReconciliation) reconcileDeployment(
 		}
 	}
 
-	return ctrl.Result{}, err
+	return resultFor(err)
 }
 
 // Reconcile handles GithubDeployments.
@@ -209,16 +240,43 @@ func (r *GithubDeploymentReconciler) Reconcile(req ctrl.Request) (ctrl.Result, e
 		log.Error(err, "unable to fetch github deployments")
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
-	ghCli, err := r.GhCli(ctx, gd.Spec.Owner, gd.Spec.Name)
+	deployer, err := r.deployerFor(ctx, &gd)
 	if err != nil {
-		log.Error(err, "unable to create gh cli for the deployment")
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		log.Error(err, "unable to create client for the deployment")
+
+		// If the app was uninstalled we can't deactivate anything
+		// but we shouldn't block deletion either
+		if !gd.ObjectMeta.DeletionTimestamp.IsZero() && dropFinalizer(&gd) {
+			return ctrl.Result{}, r.Update(ctx, &gd)
+		}
+
+		return resultFor(err)
 	}
 
-	reconciliation := GithubDeploymentReconciliation{r.Client, r.Log, r.Scheme, ghCli}
+	reconciliation := GithubDeploymentReconciliation{r.Client, r.Log, r.Scheme, deployer}
 	return reconciliation.reconcileDeployment(ctx, &gd)
 }
 
+// deployerFor gives us a Deployer for the provider of gd.
+func (r *GithubDeploymentReconciler) deployerFor(
+	ctx context.Context, gd *deployv1alpha1.GithubDeployment,
+) (Deployer, error) {
+	if gd.Spec.Provider == deployv1alpha1.GitlabProvider {
+		if r.Gitlab == nil {
+			return nil, errors.New("GitLab isn't configured")
+		}
+
+		return &gitlabDeployer{r.Gitlab}, nil
+	}
+
+	ghCli, err := r.GhCli(ctx, gd.Spec.Owner, gd.Spec.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &githubDeployer{ghCli}, nil
+}
+
 // SetupWithManager initializes our controller.
 func (r *GithubDeploymentReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
@@ -0,0 +1,37 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+)
+
+func TestNeedsDeployment(t *testing.T) {
+	var gd deployv1alpha1.GithubDeployment
+	assert.True(t, needsDeployment(&gd), "there's no deployment yet")
+
+	// From before we kept a history
+	gd.Spec.ID, gd.Spec.Sha = 1, "abc"
+	assert.True(t, seedHistory(&gd))
+	assert.False(t, needsDeployment(&gd), "the existing deployment is up to date")
+	assert.False(t, seedHistory(&gd))
+
+	gd.Spec.Sha = "def"
+	assert.True(t, needsDeployment(&gd), "a new commit was pushed")
+
+	assert.Equal(t, int64(1), recordDeployment(&gd, 2, "def"))
+	assert.False(t, needsDeployment(&gd))
+	assert.Equal(t, []deployv1alpha1.DeploymentRecord{{ID: 1, Sha: "abc"}, {ID: 2, Sha: "def"}}, gd.Status.History)
+}
+
+func TestGitlabEnvironment(t *testing.T) {
+	gd := deployv1alpha1.GithubDeployment{
+		Spec: deployv1alpha1.Deployment{Ref: "feature", PullRequest: 3, Provider: deployv1alpha1.GitlabProvider},
+	}
+	assert.Equal(t, "properator/mr-3", gitlabEnvironment(&gd))
+
+	gd.Spec.PullRequest = 0
+	assert.Equal(t, "properator/feature", gitlabEnvironment(&gd), "older deployments keep their environment")
+}
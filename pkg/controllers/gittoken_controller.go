@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
+	"github.com/michaelbeaumont/properator/pkg/utils"
+)
+
+// +kubebuilder:rbac:groups=deploy.properator.io,resources=refreleases,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;create;update
+
+const (
+	// tokenExpiresAnnotation on the credentials of flux is when its token expires
+	tokenExpiresAnnotation = "deploy.properator.io/token-expires"
+	// tokenRefresh is how long before it expires a token is replaced
+	tokenRefresh = 15 * time.Minute
+	// gitTokenUser is who git authenticates as with installation tokens
+	gitTokenUser = "x-access-token"
+)
+
+// GitTokenReconciler gives flux instances cloning over HTTPS a new
+// installation token before their current one expires.
+type GitTokenReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	Token  TokenForRepo
+}
+
+// Reconcile handles RefReleases using TokenAuth.
+func (r *GitTokenReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("refrelease", req.NamespacedName)
+
+	var refRelease deployv1alpha1.RefRelease
+	if err := r.Get(ctx, req.NamespacedName, &refRelease); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if refRelease.Spec.Repo.Auth != deployv1alpha1.TokenAuth || !refRelease.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	now := time.Now()
+
+	var current v1.Secret
+
+	nn := types.NamespacedName{Name: fluxCredentialsName, Namespace: refRelease.Namespace}
+	if err := r.Get(ctx, nn, &current); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+
+	if expires, err := time.Parse(time.RFC3339, current.Annotations[tokenExpiresAnnotation]); err == nil {
+		if refresh := expires.Add(-tokenRefresh); now.Before(refresh) {
+			return ctrl.Result{RequeueAfter: refresh.Sub(now)}, nil
+		}
+	}
+
+	repo := refRelease.Spec.Repo
+
+	token, err := r.Token(ctx, repo.Owner, repo.Name)
+	if err != nil {
+		log.Error(err, "unable to create installation token")
+		return resultFor(err)
+	}
+
+	expires := token.GetExpiresAt()
+	credentials := v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fluxCredentialsName,
+			Namespace: refRelease.Namespace,
+			Labels:    map[string]string{githubwebhook.SecretLabel: credentialsSecretValue},
+			Annotations: map[string]string{
+				tokenExpiresAnnotation: expires.UTC().Format(time.RFC3339),
+			},
+		},
+		Data: map[string][]byte{
+			gitTokenKey: []byte(token.GetToken()),
+		},
+		Type: v1.SecretTypeOpaque,
+	}
+
+	if err := ctrl.SetControllerReference(&refRelease, &credentials, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := utils.CreateOrReplace(ctx, r, r, &credentials); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// The credential helper of flux reads the new token on its next fetch
+	log.Info("refreshed installation token", "expires", expires)
+
+	requeue := expires.Add(-tokenRefresh).Sub(now)
+	if requeue <= 0 {
+		requeue = tokenRefresh
+	}
+
+	return ctrl.Result{RequeueAfter: requeue}, nil
+}
+
+// SetupWithManager initializes our controller.
+func (r *GitTokenReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("gittoken").
+		For(&deployv1alpha1.RefRelease{}).
+		Complete(r)
+}
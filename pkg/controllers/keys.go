@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	gh "github.com/google/go-github/v31/github"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"golang.org/x/crypto/ssh"
+)
+
+// keyTitle is how our deploy keys show up on repos.
+const keyTitle = "properator"
+
+// deployKeys manages the deploy keys of a repo.
+type deployKeys interface {
+	// add gives key read access, returning its ID
+	add(ctx context.Context, owner, name string, key []byte) (int64, error)
+	// find gives the ID of key, 0 if the repo doesn't have it
+	find(ctx context.Context, owner, name string, key ssh.PublicKey) (int64, error)
+	// remove doesn't fail if the key is gone already
+	remove(ctx context.Context, owner, name string, id int64) error
+}
+
+// sameKey compares an authorized_keys line with key, ignoring comments.
+func sameKey(line string, key ssh.PublicKey) bool {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	return err == nil && bytes.Equal(parsed.Marshal(), key.Marshal())
+}
+
+type githubKeys struct {
+	cli *gh.Client
+}
+
+func (k *githubKeys) add(ctx context.Context, owner, name string, key []byte) (int64, error) {
+	title, pubKey, readOnly := keyTitle, string(key), true
+	created, _, err := k.cli.Repositories.CreateKey(ctx, owner, name, &gh.Key{
+		Title: &title, Key: &pubKey, ReadOnly: &readOnly,
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return created.GetID(), nil
+}
+
+func (k *githubKeys) find(ctx context.Context, owner, name string, key ssh.PublicKey) (int64, error) {
+	opts := &gh.ListOptions{PerPage: 100}
+
+	for {
+		keys, resp, err := k.cli.Repositories.ListKeys(ctx, owner, name, opts)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, found := range keys {
+			if sameKey(found.GetKey(), key) {
+				return found.GetID(), nil
+			}
+		}
+
+		if resp.NextPage == 0 {
+			return 0, nil
+		}
+
+		opts.Page = resp.NextPage
+	}
+}
+
+func (k *githubKeys) remove(ctx context.Context, owner, name string, id int64) error {
+	resp, err := k.cli.Repositories.DeleteKey(ctx, owner, name, id)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	return err
+}
+
+type gitlabKeys struct {
+	cli *gitlab.Client
+}
+
+func (k *gitlabKeys) add(ctx context.Context, owner, name string, key []byte) (int64, error) {
+	created, err := k.cli.AddDeployKey(ctx, gitlab.Project(owner+"/"+name), keyTitle, string(key))
+	if err != nil {
+		return 0, err
+	}
+
+	return created.ID, nil
+}
+
+func (k *gitlabKeys) find(ctx context.Context, owner, name string, key ssh.PublicKey) (int64, error) {
+	keys, err := k.cli.DeployKeys(ctx, gitlab.Project(owner+"/"+name))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, found := range keys {
+		if sameKey(found.Key, key) {
+			return found.ID, nil
+		}
+	}
+
+	return 0, nil
+}
+
+func (k *gitlabKeys) remove(ctx context.Context, owner, name string, id int64) error {
+	if err := k.cli.DeleteDeployKey(ctx, gitlab.Project(owner+"/"+name), id); !gitlab.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
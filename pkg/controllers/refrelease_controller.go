@@ -10,6 +10,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
 )
 
 // +kubebuilder:rbac:groups=deploy.properator.io,resources=refreleases,verbs=get;list;watch;create;update;patch;delete
@@ -26,6 +27,8 @@ type RefReleaseReconciler struct {
 	Log       logr.Logger
 	Scheme    *runtime.Scheme
 	APIReader client.Reader
+	// Github is where flux clones from
+	Github githubwebhook.Endpoints
 }
 
 // Reconcile handles RefRelease
@@ -37,7 +40,7 @@ func (r *RefReleaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		return ctrl.Result{}, errors.Wrap(client.IgnoreNotFound(err), "unable to fetch release")
 	}
 
-	flux, err := FluxResources(ctx, r.APIReader, refRelease.ObjectMeta, refRelease.Spec)
+	flux, err := FluxResources(ctx, r.APIReader, refRelease.ObjectMeta, refRelease.Spec, r.Github)
 	if err != nil {
 		return ctrl.Result{}, errors.Wrap(err, "unable to generate flux resources")
 	}
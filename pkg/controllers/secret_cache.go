@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
+	"github.com/michaelbeaumont/properator/pkg/utils"
+)
+
+var secretGVK = v1.SchemeGroupVersion.WithKind("Secret")
+
+// secretCache only caches the Secrets labeled with githubwebhook.SecretLabel
+// instead of every Secret in the cluster. Everything else is cached as usual.
+type secretCache struct {
+	cache.Cache
+	secrets toolscache.SharedIndexInformer
+}
+
+// NewCache is a cache.NewCacheFunc caching only the Secrets we manage.
+func NewCache(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+	c, err := cache.New(config, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	resync := 10 * time.Hour
+	if opts.Resync != nil {
+		resync = *opts.Resync
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		clientset, resync,
+		informers.WithNamespace(opts.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = githubwebhook.SecretLabel
+		}),
+	)
+
+	return &secretCache{Cache: c, secrets: factory.Core().V1().Secrets().Informer()}, nil
+}
+
+func (c *secretCache) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	secret, ok := obj.(*v1.Secret)
+	if !ok {
+		return c.Cache.Get(ctx, key, obj)
+	}
+
+	item, exists, err := c.secrets.GetStore().GetByKey(key.String())
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, key.Name)
+	}
+
+	item.(*v1.Secret).DeepCopyInto(secret)
+
+	return nil
+}
+
+func (c *secretCache) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	secrets, ok := list.(*v1.SecretList)
+	if !ok {
+		return c.Cache.List(ctx, list, opts...)
+	}
+
+	var listOpts client.ListOptions
+	listOpts.ApplyOptions(opts)
+
+	if listOpts.FieldSelector != nil && !listOpts.FieldSelector.Empty() {
+		return errors.New("cached secrets can't be listed by field")
+	}
+
+	selector := listOpts.LabelSelector
+	if selector == nil {
+		selector = labels.Everything()
+	}
+
+	secrets.Items = nil
+
+	for _, item := range c.secrets.GetStore().List() {
+		secret := item.(*v1.Secret)
+		if listOpts.Namespace != "" && secret.Namespace != listOpts.Namespace {
+			continue
+		}
+
+		if selector.Matches(labels.Set(secret.Labels)) {
+			secrets.Items = append(secrets.Items, *secret.DeepCopy())
+		}
+	}
+
+	return nil
+}
+
+func (c *secretCache) GetInformer(ctx context.Context, obj runtime.Object) (cache.Informer, error) {
+	if _, ok := obj.(*v1.Secret); ok {
+		return c.secrets, nil
+	}
+
+	return c.Cache.GetInformer(ctx, obj)
+}
+
+func (c *secretCache) GetInformerForKind(ctx context.Context, gvk schema.GroupVersionKind) (cache.Informer, error) {
+	if gvk == secretGVK {
+		return c.secrets, nil
+	}
+
+	return c.Cache.GetInformerForKind(ctx, gvk)
+}
+
+func (c *secretCache) Start(stop <-chan struct{}) error {
+	go c.secrets.Run(stop)
+	return c.Cache.Start(stop)
+}
+
+func (c *secretCache) WaitForCacheSync(stop <-chan struct{}) bool {
+	if !toolscache.WaitForCacheSync(stop, c.secrets.HasSynced) {
+		return false
+	}
+
+	return c.Cache.WaitForCacheSync(stop)
+}
+
+func (c *secretCache) IndexField(ctx context.Context, obj runtime.Object, field string, extractValue client.IndexerFunc) error {
+	if _, ok := obj.(*v1.Secret); ok {
+		return errors.New("cached secrets can't be indexed")
+	}
+
+	return c.Cache.IndexField(ctx, obj, field, extractValue)
+}
+
+// LabelSecrets labels the secrets we created before labeling them once the
+// manager starts, since the cache wouldn't see them otherwise.
+func LabelSecrets(mgr ctrl.Manager, log logr.Logger) error {
+	return mgr.Add(manager.RunnableFunc(func(<-chan struct{}) error {
+		if err := labelSecrets(context.Background(), mgr.GetAPIReader(), mgr.GetClient()); err != nil {
+			log.Error(err, "unable to label secrets")
+		}
+
+		return nil
+	}))
+}
+
+func labelSecrets(ctx context.Context, r client.Reader, c client.Client) error {
+	namespace, err := utils.GetCurrentNamespace()
+	if err != nil {
+		return err
+	}
+
+	var keys v1.SecretList
+	if err := r.List(ctx, &keys, client.InNamespace(namespace)); err != nil {
+		return err
+	}
+
+	for i := range keys.Items {
+		secret := &keys.Items[i]
+		_, labeled := secret.Labels[githubwebhook.DeployKeyLabel]
+
+		if labeled || strings.HasPrefix(secret.Name, keySecretPrefix) {
+			if err := labelSecret(ctx, c, secret, githubwebhook.DeployKeySecret); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, value := range map[string]string{
+		fluxDeployKeyName:   fluxSecretValue,
+		fluxCredentialsName: credentialsSecretValue,
+	} {
+		var secrets v1.SecretList
+		if err := r.List(ctx, &secrets, client.MatchingFields{"metadata.name": name}); err != nil {
+			return err
+		}
+
+		for i := range secrets.Items {
+			if err := labelSecret(ctx, c, &secrets.Items[i], value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func labelSecret(ctx context.Context, c client.Client, secret *v1.Secret, value string) error {
+	if _, ok := secret.Labels[githubwebhook.SecretLabel]; ok {
+		return nil
+	}
+
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+
+	secret.Labels[githubwebhook.SecretLabel] = value
+
+	return errors.Wrapf(c.Update(ctx, secret), "couldn't label secret %s/%s", secret.Namespace, secret.Name)
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/michaelbeaumont/properator/pkg/githubwebhook"
+	"github.com/michaelbeaumont/properator/pkg/utils"
+)
+
+func TestSecretCache(t *testing.T) {
+	ctx := context.Background()
+	informer := toolscache.NewSharedIndexInformer(&toolscache.ListWatch{}, &v1.Secret{}, 0, toolscache.Indexers{})
+	c := &secretCache{secrets: informer}
+
+	flux := &v1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name: fluxDeployKeyName, Namespace: "env", Labels: fluxSecretLabels(),
+	}}
+	key := &v1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name: keySecretPrefix + "1", Namespace: "properator",
+		Labels: map[string]string{githubwebhook.SecretLabel: githubwebhook.DeployKeySecret},
+	}}
+	assert.NoError(t, informer.GetStore().Add(flux))
+	assert.NoError(t, informer.GetStore().Add(key))
+
+	var found v1.Secret
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Name: fluxDeployKeyName, Namespace: "env"}, &found))
+	assert.Equal(t, flux, &found)
+
+	err := c.Get(ctx, types.NamespacedName{Name: fluxDeployKeyName, Namespace: "other"}, &found)
+	assert.True(t, apierrors.IsNotFound(err))
+
+	var secrets v1.SecretList
+	assert.NoError(t, c.List(ctx, &secrets, client.InNamespace("properator")))
+	assert.Equal(t, []v1.Secret{*key}, secrets.Items)
+
+	assert.NoError(t, c.List(ctx, &secrets, client.MatchingLabels{githubwebhook.SecretLabel: fluxSecretValue}))
+	assert.Equal(t, []v1.Secret{*flux}, secrets.Items)
+}
+
+func TestLabelSecrets(t *testing.T) {
+	os.Setenv(utils.NamespaceEnv, "properator")
+	defer os.Unsetenv(utils.NamespaceEnv)
+
+	ctx := context.Background()
+	secret := func(namespace, name string) *v1.Secret {
+		return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	}
+	k8s := fake.NewFakeClient(
+		secret("properator", keySecretPrefix+"1"),
+		secret("properator", "unrelated"),
+		secret("env", fluxDeployKeyName),
+		secret("env", fluxCredentialsName),
+		secret("env", "unrelated"),
+	)
+
+	// The fake client can't list by field, so take the namespaces in turn
+	assert.NoError(t, labelSecrets(ctx, namespaced{k8s, "properator"}, k8s))
+	assert.NoError(t, labelSecrets(ctx, namespaced{k8s, "env"}, k8s))
+
+	label := func(namespace, name string) string {
+		var found v1.Secret
+		assert.NoError(t, k8s.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, &found))
+		return found.Labels[githubwebhook.SecretLabel]
+	}
+	assert.Equal(t, githubwebhook.DeployKeySecret, label("properator", keySecretPrefix+"1"))
+	assert.Equal(t, "", label("properator", "unrelated"))
+	assert.Equal(t, fluxSecretValue, label("env", fluxDeployKeyName))
+	assert.Equal(t, credentialsSecretValue, label("env", fluxCredentialsName))
+	assert.Equal(t, "", label("env", "unrelated"))
+}
+
+// namespaced lists secrets named like a field selector asks for in a single
+// namespace.
+type namespaced struct {
+	client.Reader
+	namespace string
+}
+
+func (r namespaced) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	var listOpts client.ListOptions
+	listOpts.ApplyOptions(opts)
+
+	if listOpts.FieldSelector == nil {
+		return r.Reader.List(ctx, list, opts...)
+	}
+
+	if err := r.Reader.List(ctx, list, client.InNamespace(r.namespace)); err != nil {
+		return err
+	}
+
+	secrets := list.(*v1.SecretList)
+	name, _ := listOpts.FieldSelector.RequiresExactMatch("metadata.name")
+
+	var matching []v1.Secret
+
+	for _, secret := range secrets.Items {
+		if secret.Name == name {
+			matching = append(matching, secret)
+		}
+	}
+
+	secrets.Items = matching
+
+	return nil
+}
@@ -2,6 +2,7 @@ package githubwebhook
 
 import (
 	"fmt"
+	"strings"
 )
 
 type action interface {
@@ -9,13 +10,33 @@ type action interface {
 	Describe() string
 }
 
+// detailed actions have more to tell users once they're done.
+type detailed interface {
+	Details() string
+}
+
 type prPointer struct {
-	id     int64
-	number int
+	// provider is empty for GitHub
+	provider string
+	id       int64
+	number   int
+}
+
+// prefix keeps names of other providers apart from GitHub's.
+func (pr prPointer) prefix() string {
+	if pr.provider == "" {
+		return ""
+	}
+	return pr.provider + "-"
 }
 
-func (pr prPointer) getNamespaced() (string, string) {
-	return "github-webhook", fmt.Sprintf("properator-github-webhook-%v-%v", pr.id, pr.number)
+// defaultNamespace is the namespace of the environment of a PR if no
+// NamespaceConfig.NameTemplate is given.
+func (pr prPointer) defaultNamespace() string {
+	if pr.provider != "" {
+		return fmt.Sprintf("properator-%s%v-%v", pr.prefix(), pr.id, pr.number)
+	}
+	return fmt.Sprintf("properator-github-webhook-%v-%v", pr.id, pr.number)
 }
 
 type noopAction struct {
@@ -29,6 +50,38 @@ func (ca *noopAction) Describe() string {
 	return ""
 }
 
+// sequence runs actions one after another, stopping at the first error.
+type sequence []action
+
+func (s sequence) Act(webhook *WebhookHandler) error {
+	for _, a := range s {
+		if err := a.Act(webhook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s sequence) Describe() string {
+	var descs []string
+	for _, a := range s {
+		if desc := a.Describe(); desc != "" {
+			descs = append(descs, desc)
+		}
+	}
+	return strings.Join(descs, ", ")
+}
+
+func (s sequence) Details() string {
+	var details []string
+	for _, a := range s {
+		if d, ok := a.(detailed); ok && d.Details() != "" {
+			details = append(details, d.Details())
+		}
+	}
+	return strings.Join(details, "\n\n")
+}
+
 var (
 	transientEnvironment = true
 	readOnlyKey          = true
@@ -38,4 +91,14 @@ var (
 	inactive             = "inactive"
 )
 
-const annotation = "deploy.properator.io/github-webhook"
+// EnvironmentAnnotation marks the namespaces of environments
+const EnvironmentAnnotation = "deploy.properator.io/github-webhook"
+
+// Labels on environment namespaces
+const (
+	repoLabel         = "deploy.properator.io/repo-id"
+	pullRequestLabel  = "deploy.properator.io/pull-request"
+	installationLabel = "deploy.properator.io/installation-id"
+	// providerLabel is only set for providers other than GitHub
+	providerLabel = "deploy.properator.io/provider"
+)
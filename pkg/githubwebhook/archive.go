@@ -0,0 +1,130 @@
+package githubwebhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// archivedEvent is how an Event is written to disk.
+type archivedEvent struct {
+	Type       string          `json:"type"`
+	DeliveryID string          `json:"deliveryID,omitempty"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Archive keeps the most recent webhook payloads in a directory, one file
+// per delivery.
+type Archive struct {
+	dir string
+	max int
+	mu  sync.Mutex
+}
+
+// NewArchive creates an archive keeping at most max deliveries in dir.
+func NewArchive(dir string, max int) (*Archive, error) {
+	if max < 1 {
+		return nil, errors.New("archive must be able to keep at least one delivery")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "couldn't create archive directory")
+	}
+	return &Archive{dir: dir, max: max}, nil
+}
+
+// archiveName sorts deliveries by when they were received.
+func archiveName(event Event) string {
+	name := fmt.Sprintf("%s-%s", event.ReceivedAt.UTC().Format("20060102T150405.000000000"), event.Type)
+	if event.DeliveryID != "" {
+		name += "-" + event.DeliveryID
+	}
+	return name + ".json"
+}
+
+// Save writes an event to the archive, removing the oldest ones if there are
+// too many.
+func (a *Archive) Save(event Event) error {
+	if err := checkDeliveryID(event.DeliveryID); err != nil {
+		return err
+	}
+
+	contents, err := json.MarshalIndent(archivedEvent{
+		Type:       event.Type,
+		DeliveryID: event.DeliveryID,
+		ReceivedAt: event.ReceivedAt,
+		Payload:    event.Payload,
+	}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "couldn't encode event")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := ioutil.WriteFile(filepath.Join(a.dir, archiveName(event)), contents, 0644); err != nil {
+		return errors.Wrap(err, "couldn't archive event")
+	}
+
+	return a.prune()
+}
+
+func (a *Archive) prune() error {
+	files, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return errors.Wrap(err, "couldn't list archive")
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for len(names) > a.max {
+		if err := os.Remove(filepath.Join(a.dir, names[0])); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "couldn't remove archived event")
+		}
+		names = names[1:]
+	}
+
+	return nil
+}
+
+// LoadEvent reads an archived event or, if eventType is given, a raw payload
+// like the ones shown under "Recent Deliveries" on GitHub.
+func LoadEvent(path string, eventType string) (Event, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Event{}, errors.Wrap(err, "couldn't read event")
+	}
+
+	if eventType != "" {
+		return Event{Type: eventType, ReceivedAt: time.Now(), Payload: contents}, nil
+	}
+
+	var archived archivedEvent
+	if err := json.Unmarshal(contents, &archived); err != nil {
+		return Event{}, errors.Wrap(err, "couldn't decode archived event")
+	}
+	if archived.Type == "" || len(archived.Payload) == 0 {
+		return Event{}, errors.Errorf("%s isn't an archived event, the event type is needed", path)
+	}
+
+	return Event{
+		Type:       archived.Type,
+		DeliveryID: archived.DeliveryID,
+		ReceivedAt: archived.ReceivedAt,
+		Payload:    archived.Payload,
+	}, nil
+}
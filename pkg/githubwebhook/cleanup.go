@@ -0,0 +1,145 @@
+package githubwebhook
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	gh "github.com/google/go-github/v31/github"
+	"github.com/michaelbeaumont/properator/pkg/utils"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;create;delete
+
+// cleanup removes everything we've created for repositories
+// the app can no longer access.
+type cleanup struct {
+	// installationID is set if the whole installation was removed
+	installationID int64
+	repos          []*gh.Repository
+}
+
+// ownsNamespace tells us whether ns is an environment of the repo
+// with ID repoID or, if installationID isn't 0, of the installation.
+func ownsNamespace(ns *v1.Namespace, installationID int64, repoIDs map[int64]bool) bool {
+	if _, ok := ns.Annotations[EnvironmentAnnotation]; !ok {
+		return false
+	}
+	if _, ok := ns.Labels[providerLabel]; ok {
+		return false
+	}
+	if installationID != 0 && ns.Labels[installationLabel] == strconv.FormatInt(installationID, 10) {
+		return true
+	}
+	if id, err := strconv.ParseInt(ns.Labels[repoLabel], 10, 64); err == nil {
+		return repoIDs[id]
+	}
+	// Environments from before we labeled them
+	for id := range repoIDs {
+		if strings.HasPrefix(ns.Name, fmt.Sprintf("properator-github-webhook-%v-", id)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cleanup) Act(webhook *WebhookHandler) error {
+	ctx := context.Background()
+	currentNs, err := utils.GetCurrentNamespace()
+	if err != nil {
+		return err
+	}
+
+	repoIDs := map[int64]bool{}
+	for _, repo := range c.repos {
+		repoIDs[repo.GetID()] = true
+	}
+
+	var namespaces v1.NamespaceList
+	if err := webhook.k8s.List(ctx, &namespaces); err != nil {
+		return err
+	}
+	var errs []string
+	for i := range namespaces.Items {
+		ns := &namespaces.Items[i]
+		if !ownsNamespace(ns, c.installationID, repoIDs) {
+			continue
+		}
+		if err := webhook.k8s.Delete(ctx, ns); client.IgnoreNotFound(err) != nil {
+			errs = append(errs, errors.Wrapf(err, "couldn't delete namespace %s", ns.Name).Error())
+		}
+	}
+
+	var records v1.ConfigMapList
+	if err := webhook.k8s.List(
+		ctx, &records, client.InNamespace(currentNs), client.MatchingLabels{closedLabel: "true"},
+	); err != nil {
+		return err
+	}
+	for i := range records.Items {
+		record := &records.Items[i]
+		for id := range repoIDs {
+			if !strings.HasPrefix(record.Name, fmt.Sprintf("properator-closed-%v-", id)) {
+				continue
+			}
+			if err := webhook.k8s.Delete(ctx, record); client.IgnoreNotFound(err) != nil {
+				errs = append(errs, errors.Wrapf(err, "couldn't delete record %s", record.Name).Error())
+			}
+		}
+	}
+
+	for _, repo := range c.repos {
+		secret := v1.Secret{}
+		nn := types.NamespacedName{Name: deployKeySecretName(repo.GetID()), Namespace: currentNs}
+		if err := webhook.k8s.Get(ctx, nn, &secret); err != nil {
+			if client.IgnoreNotFound(err) != nil {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+		// The manager removes the deploy key from the repo, if it still can
+		if err := webhook.k8s.Delete(ctx, &secret); client.IgnoreNotFound(err) != nil {
+			errs = append(errs, errors.Wrapf(err, "couldn't delete %s", nn.Name).Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Errorf("cleaning up failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (c *cleanup) Describe() string {
+	var names []string
+	for _, repo := range c.repos {
+		names = append(names, repo.GetFullName())
+	}
+	if c.installationID != 0 {
+		return fmt.Sprintf("Cleaning up installation %d (%s)", c.installationID, strings.Join(names, ", "))
+	}
+	return fmt.Sprintf("Cleaning up %s", strings.Join(names, ", "))
+}
+
+func parseInstallationEvent(event *gh.InstallationEvent) action {
+	if event.GetAction() != "deleted" {
+		return nil
+	}
+	return &cleanup{
+		installationID: event.GetInstallation().GetID(),
+		repos:          event.Repositories,
+	}
+}
+
+func parseInstallationRepositoriesEvent(event *gh.InstallationRepositoriesEvent) action {
+	if event.GetAction() != "removed" || len(event.RepositoriesRemoved) == 0 {
+		return nil
+	}
+	return &cleanup{
+		repos: event.RepositoriesRemoved,
+	}
+}
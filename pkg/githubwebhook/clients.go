@@ -0,0 +1,145 @@
+package githubwebhook
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	gh "github.com/google/go-github/v31/github"
+)
+
+// installationForRepo looks up the installation of our app on a repo.
+type installationForRepo func(ctx context.Context, owner, repo string) (int64, error)
+
+type cachedClient struct {
+	cli     *gh.Client
+	expires time.Time
+}
+
+type cachedInstallation struct {
+	id      int64
+	expires time.Time
+}
+
+// ClientCache keeps clients per installation and installations per repo for
+// a while, so we don't look them up and authenticate for every event.
+type ClientCache struct {
+	ttl              time.Duration
+	newClient        ClientForInstallation
+	findInstallation installationForRepo
+	now              func() time.Time
+
+	mu            sync.Mutex
+	clients       map[int64]cachedClient
+	installations map[string]cachedInstallation
+}
+
+// newClientCache caches for ttl, nothing is cached if it's 0.
+func newClientCache(ttl time.Duration, newClient ClientForInstallation, find installationForRepo) *ClientCache {
+	return &ClientCache{
+		ttl:              ttl,
+		newClient:        newClient,
+		findInstallation: find,
+		now:              time.Now,
+		clients:          map[int64]cachedClient{},
+		installations:    map[string]cachedInstallation{},
+	}
+}
+
+// ForInstallation gives us a client authenticated as an installation.
+func (c *ClientCache) ForInstallation(installationID int64) (*gh.Client, error) {
+	now := c.now()
+
+	c.mu.Lock()
+	cached, ok := c.clients[installationID]
+	c.mu.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached.cli, nil
+	}
+
+	cli, err := c.newClient(installationID)
+	if err != nil || c.ttl <= 0 {
+		return cli, err
+	}
+
+	c.mu.Lock()
+	c.clients[installationID] = cachedClient{cli, now.Add(c.ttl)}
+	c.mu.Unlock()
+
+	return cli, nil
+}
+
+// ForRepo gives us a client for the installation of our app on a repo.
+func (c *ClientCache) ForRepo(ctx context.Context, owner, repo string) (*gh.Client, error) {
+	id, err := c.InstallationForRepo(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ForInstallation(id)
+}
+
+// InstallationForRepo gives us the ID of the installation of our app on a repo.
+func (c *ClientCache) InstallationForRepo(ctx context.Context, owner, repo string) (int64, error) {
+	key := owner + "/" + repo
+	now := c.now()
+
+	c.mu.Lock()
+	cached, ok := c.installations[key]
+	c.mu.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached.id, nil
+	}
+
+	id, err := c.findInstallation(ctx, owner, repo)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.ttl > 0 {
+		c.mu.Lock()
+		c.installations[key] = cachedInstallation{id, now.Add(c.ttl)}
+		c.mu.Unlock()
+	}
+
+	return id, nil
+}
+
+// ForgetInstallation drops the client of an installation and the repos we
+// know it's installed on.
+func (c *ClientCache) ForgetInstallation(installationID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.clients, installationID)
+
+	for key, cached := range c.installations {
+		if cached.id == installationID {
+			delete(c.installations, key)
+		}
+	}
+}
+
+// forgetOnFailure wraps the transport of an installation so that it's
+// forgotten once a call through it gets a 401 or 404, which is how GitHub
+// answers once the app is uninstalled or removed from a repo.
+func (c *ClientCache) forgetOnFailure(installationID int64, next http.RoundTripper) http.RoundTripper {
+	return &forgettingTransport{next: next, cache: c, installationID: installationID}
+}
+
+type forgettingTransport struct {
+	next           http.RoundTripper
+	cache          *ClientCache
+	installationID int64
+}
+
+func (t *forgettingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusNotFound) {
+		t.cache.ForgetInstallation(t.installationID)
+	}
+	return resp, err
+}
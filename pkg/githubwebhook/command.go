@@ -0,0 +1,276 @@
+package githubwebhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// command is implemented by every typed comment command.
+// A comment can contain any number of commands, each on its own line,
+// in the form:
+//
+//	@<app> <verb> [--flag[=value]] [key=value]...
+//
+// Values may be quoted with single or double quotes.
+type command interface {
+	verb() string
+}
+
+// deployCommand launches an environment for the PR.
+type deployCommand struct {
+	// path restricts flux to a (comma separated) set of paths in the repo
+	path string
+	// ttl overrides the default TTL of the environment
+	ttl time.Duration
+}
+
+func (deployCommand) verb() string {
+	return "deploy"
+}
+
+// dropCommand removes the environment of the PR.
+type dropCommand struct{}
+
+func (dropCommand) verb() string {
+	return "drop"
+}
+
+// statusCommand reports on the environment of the PR.
+type statusCommand struct{}
+
+func (statusCommand) verb() string {
+	return "status"
+}
+
+// redeployCommand restarts flux on the latest commit of the PR.
+type redeployCommand struct{}
+
+func (redeployCommand) verb() string {
+	return "redeploy"
+}
+
+// extendCommand pushes back the expiry of the environment of the PR.
+type extendCommand struct {
+	// ttl replaces the TTL of the environment
+	ttl time.Duration
+}
+
+func (extendCommand) verb() string {
+	return "extend"
+}
+
+// arguments holds the flags given to a command.
+type arguments map[string]string
+
+// take consumes the argument `key`.
+func (args arguments) take(key string) (string, bool) {
+	v, ok := args[key]
+	delete(args, key)
+
+	return v, ok
+}
+
+// takeDuration consumes the positive duration `key`, like 72h, 0 if missing.
+func (args arguments) takeDuration(key string) (time.Duration, error) {
+	raw, ok := args.take(key)
+	if !ok {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("expected a positive duration like 72h for %s, got %q", key, raw)
+	}
+
+	return d, nil
+}
+
+// done checks that every argument has been consumed.
+func (args arguments) done(verb string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	var unknown []string
+	for k := range args {
+		unknown = append(unknown, k)
+	}
+
+	sort.Strings(unknown)
+
+	return errors.Errorf("unknown argument(s) for %s: %s", verb, strings.Join(unknown, ", "))
+}
+
+type commandParser func(args arguments) (command, error)
+
+var commandParsers = map[string]commandParser{
+	"deploy":   parseDeploy,
+	"drop":     parseDrop,
+	"delete":   parseDrop,
+	"status":   parseStatus,
+	"extend":   parseExtend,
+	"redeploy": parseRedeploy,
+}
+
+func parseDeploy(args arguments) (command, error) {
+	var cmd deployCommand
+	cmd.path, _ = args.take("path")
+
+	ttl, err := args.takeDuration("ttl")
+	if err != nil {
+		return nil, err
+	}
+	cmd.ttl = ttl
+
+	return cmd, args.done(cmd.verb())
+}
+
+func parseDrop(args arguments) (command, error) {
+	var cmd dropCommand
+	return cmd, args.done(cmd.verb())
+}
+
+func parseStatus(args arguments) (command, error) {
+	var cmd statusCommand
+	return cmd, args.done(cmd.verb())
+}
+
+func parseExtend(args arguments) (command, error) {
+	var cmd extendCommand
+
+	ttl, err := args.takeDuration("ttl")
+	if err != nil {
+		return nil, err
+	}
+	cmd.ttl = ttl
+
+	return cmd, args.done(cmd.verb())
+}
+
+func parseRedeploy(args arguments) (command, error) {
+	var cmd redeployCommand
+	return cmd, args.done(cmd.verb())
+}
+
+// tokenize splits a line on whitespace, respecting quotes.
+func tokenize(line string) ([]string, error) {
+	var (
+		tokens  []string
+		current strings.Builder
+		quote   rune
+		inToken bool
+	)
+
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inToken = true
+		case unicode.IsSpace(r):
+			if inToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				inToken = false
+			}
+		default:
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.Errorf("unterminated %c in %q", quote, line)
+	}
+
+	if inToken {
+		tokens = append(tokens, current.String())
+	}
+
+	return tokens, nil
+}
+
+// parseArguments understands `--flag`, `--flag=value` and `key=value`.
+func parseArguments(tokens []string) (arguments, error) {
+	args := arguments{}
+
+	for _, token := range tokens {
+		trimmed := strings.TrimPrefix(token, "--")
+		key, value := trimmed, "true"
+
+		if i := strings.Index(trimmed, "="); i >= 0 {
+			key, value = trimmed[:i], trimmed[i+1:]
+		} else if trimmed == token {
+			return nil, errors.Errorf("expected --flag or key=value, got %q", token)
+		}
+
+		if key == "" {
+			return nil, errors.Errorf("missing argument name in %q", token)
+		}
+
+		if _, ok := args[key]; ok {
+			return nil, errors.Errorf("argument %s given more than once", key)
+		}
+
+		args[key] = value
+	}
+
+	return args, nil
+}
+
+// parseCommands finds every line addressed to `@name` in a comment body.
+// Lines quoted with `>` are ignored so that replies don't repeat commands.
+func parseCommands(name, body string) ([]command, error) {
+	var commands []command
+
+	mention := fmt.Sprintf("@%s", name)
+
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, mention) {
+			continue
+		}
+
+		rest := line[len(mention):]
+		if rest != "" && !unicode.IsSpace([]rune(rest)[0]) {
+			// e.g. @name-other
+			continue
+		}
+
+		tokens, err := tokenize(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(tokens) == 0 {
+			continue
+		}
+
+		parse, ok := commandParsers[tokens[0]]
+		if !ok {
+			return nil, errors.Errorf("unknown command %q", tokens[0])
+		}
+
+		args, err := parseArguments(tokens[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't parse arguments to %s", tokens[0])
+		}
+
+		cmd, err := parse(args)
+		if err != nil {
+			return nil, err
+		}
+
+		commands = append(commands, cmd)
+	}
+
+	return commands, nil
+}
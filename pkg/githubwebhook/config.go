@@ -0,0 +1,114 @@
+package githubwebhook
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Config holds the settings of the webhook.
+type Config struct {
+	// Permissions maps commands to the minimum repository permission
+	// a commenter needs to use them.
+	Permissions map[string]string
+	// Teams, if not empty, restricts commands needing more than read
+	// permission to members of at least one of these `org/team-slug`s.
+	Teams []string
+	// DeployLabel, if set, deploys PRs while they have this label.
+	DeployLabel string
+	// Debounce is how long an action on a PR is skipped after the same
+	// action succeeded.
+	Debounce time.Duration
+	// Forks is the policy for PRs from forks, ForksDeny if empty.
+	Forks string
+	// KeyType of new deploy keys, KeyRSA if empty.
+	KeyType string
+	// GitAuth is how flux authenticates with GitHub repos, with deploy keys
+	// unless it's deployv1alpha1.TokenAuth.
+	GitAuth string
+	// Namespaces sets up the namespaces of environments, with the defaults
+	// if nil.
+	Namespaces *NamespaceConfig
+	// TTL is how long environments live after they're deployed or extended,
+	// unless the deploy command says otherwise. Forever if 0.
+	TTL time.Duration
+	// IdleTTL is how long environments live without new commits. Forever
+	// if 0.
+	IdleTTL time.Duration
+	// ClosedRetention is how long the environments of closed PRs are
+	// remembered so they can be restored. Forever if 0.
+	ClosedRetention time.Duration
+}
+
+// DefaultPermissions is the default value of `Config.Permissions`.
+const DefaultPermissions = "deploy=write,drop=write,extend=write,redeploy=write,status=read"
+
+// ParsePermissions parses a list like `deploy=write,status=read`. Commands
+// that aren't listed keep their permission from DefaultPermissions.
+func ParsePermissions(raw string) (map[string]string, error) {
+	permissions := map[string]string{}
+
+	if err := parsePermissions(DefaultPermissions, permissions); err != nil {
+		return nil, err
+	}
+
+	if err := parsePermissions(raw, permissions); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// parsePermissions adds the entries of raw to permissions, under the
+// canonical verb of aliases like `delete`.
+func parsePermissions(raw string, permissions map[string]string) error {
+	for _, entry := range strings.Split(raw, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("expected command=permission, got %q", entry)
+		}
+
+		name, level := parts[0], parts[1]
+		parse, ok := commandParsers[name]
+		if !ok {
+			return errors.Errorf("unknown command %q", name)
+		}
+
+		if _, ok := permissionRanks[level]; !ok {
+			return errors.Errorf("unknown permission %q for %s", level, name)
+		}
+
+		cmd, err := parse(arguments{})
+		if err != nil {
+			return err
+		}
+
+		permissions[cmd.verb()] = level
+	}
+
+	return nil
+}
+
+// ParseTeams parses a list like `org/team,org/other-team`.
+func ParseTeams(raw string) ([]string, error) {
+	var teams []string
+
+	for _, team := range strings.Split(raw, ",") {
+		if team = strings.TrimSpace(team); team == "" {
+			continue
+		}
+
+		if parts := strings.Split(team, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("expected org/team, got %q", team)
+		}
+
+		teams = append(teams, team)
+	}
+
+	return teams, nil
+}
@@ -3,41 +3,85 @@ package githubwebhook
 import (
 	"context"
 	"fmt"
-	"net/http"
+	"strconv"
+	"time"
 
-	gh "github.com/google/go-github/v31/github"
 	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
 	"github.com/michaelbeaumont/properator/pkg/utils"
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;create;patch
+
 type create struct {
 	owner  string
 	name   string
 	branch string
+	path   string
 	pr     prPointer
+	// ttl overrides the default TTL of the environment if not 0
+	ttl time.Duration
+}
+
+// deployKeySecretName is where we keep the deploy key of a GitHub repo.
+func deployKeySecretName(repoID int64) string {
+	return fmt.Sprintf("properator-git-deploy-key-%v", repoID)
+}
+
+// keySecretName is where we keep the deploy key of the repo of a PR.
+func (pr prPointer) keySecretName() string {
+	if pr.provider != "" {
+		return fmt.Sprintf("properator-git-deploy-key-%s%v", pr.prefix(), pr.id)
+	}
+	return deployKeySecretName(pr.id)
+}
+
+// tokenAuth tells us whether flux clones GitHub repos with installation
+// tokens instead of deploy keys.
+func (webhook *WebhookHandler) tokenAuth() bool {
+	return webhook.config.GitAuth == deployv1alpha1.TokenAuth && webhook.installationID != 0
 }
 
 func (ca *create) ensureGitKeySecret(ctx context.Context, webhook *WebhookHandler) (secretName string, err error) {
-	name := fmt.Sprintf("properator-git-deploy-key-%v", ca.pr.id)
+	name := ca.pr.keySecretName()
+	err = ensureKeySecret(ctx, webhook, name, ca.pr.provider, ca.owner, ca.name, func(key []byte) (int64, error) {
+		id, err := webhook.provider.addDeployKey(ctx, ca.owner, ca.name, key)
+		return id, errors.Wrapf(err, "error creating deploy key for repository %s/%s", ca.owner, ca.name)
+	})
+	return name, err
+}
+
+// ensureKeySecret generates a deploy key kept in the secret name, unless it
+// exists already, and adds its public key to the repo owner/repoName with addKey.
+func ensureKeySecret(
+	ctx context.Context, webhook *WebhookHandler, name, provider, owner, repoName string,
+	addKey func(key []byte) (int64, error),
+) error {
 	currentNs, err := utils.GetCurrentNamespace()
 	if err != nil {
-		return "", err
+		return err
 	}
 	secretNN := types.NamespacedName{Name: name, Namespace: currentNs}
 	if err := webhook.k8s.Get(ctx, secretNN, &v1.Secret{}); err != nil {
-		keyPair, err := generateKey()
+		keyPair, err := GenerateKey(webhook.config.KeyType)
 		if err != nil {
-			return "", errors.Wrap(err, "couldn't generate ssh key")
+			return errors.Wrap(err, "couldn't generate ssh key")
+		}
+		annotations := map[string]string{KeyRepoAnnotation: owner + "/" + repoName}
+		if provider != "" {
+			annotations[KeyProviderAnnotation] = provider
 		}
 		// save this key to our properator namespace
 		keySecret := v1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name: name, Namespace: currentNs,
+				Labels:      map[string]string{DeployKeyLabel: "true", SecretLabel: DeployKeySecret},
+				Annotations: annotations,
 			},
 			Data: map[string][]byte{
 				"identity": keyPair.Private,
@@ -45,76 +89,110 @@ func (ca *create) ensureGitKeySecret(ctx context.Context, webhook *WebhookHandle
 			Type: v1.SecretTypeOpaque,
 		}
 		if err := webhook.k8s.Create(ctx, &keySecret); err != nil {
-			return "", errors.Wrap(err, "couldn't create deploy key secret for repo")
+			return errors.Wrap(err, "couldn't create deploy key secret for repo")
 		}
 		// add this key to our repo's deploy keys
-		pubKey := string(keyPair.Public)
-		ghKey := gh.Key{Title: &properator, Key: &pubKey, ReadOnly: &readOnlyKey}
-		_, resp, err := webhook.ghCli.Repositories.CreateKey(ctx, ca.owner, ca.name, &ghKey)
+		id, err := addKey(keyPair.Public)
 		if err != nil {
-			return "", errors.Wrapf(err, "error creating deploy key for repository %s/%s", ca.owner, ca.name)
-		}
-		if resp.StatusCode != http.StatusCreated {
-			return "", errors.Errorf("error creating deploy key for repository %s/%s: %d", ca.owner, ca.name, resp.StatusCode)
+			return err
 		}
+		// so the manager knows which key to replace or remove
+		patch := client.MergeFrom(keySecret.DeepCopy())
+		keySecret.Annotations[KeyIDAnnotation] = strconv.FormatInt(id, 10)
+		return errors.Wrap(webhook.k8s.Patch(ctx, &keySecret, patch), "couldn't record ID of deploy key")
 	}
-	return name, nil
+	return nil
 }
 
 func (ca *create) Act(webhook *WebhookHandler) error {
 	ctx := context.Background()
-	pr, _, err := webhook.ghCli.PullRequests.Get(ctx, ca.owner, ca.name, ca.pr.number)
+	pr, err := webhook.provider.pullRequest(ctx, ca.owner, ca.name, ca.pr.number)
 	if err != nil {
 		return err
 	}
-	name, namespace := ca.pr.getNamespaced()
-
-	ref := pr.GetHead().GetRef()
-	nn := types.NamespacedName{Name: name, Namespace: namespace}
-	if err := webhook.k8s.Get(ctx, nn, &v1.Namespace{}); err != nil {
-		ns := v1.Namespace{
+	if pr.fork != nil {
+		if err := webhook.checkFork(ctx, ca.owner, ca.name, ca.pr.number, pr.sha); err != nil {
+			return err
+		}
+	}
+	ns, err := webhook.environment(ctx, ca.pr)
+	if err != nil {
+		return err
+	}
+	if ns == nil {
+		name, err := webhook.namespaceName(ca.pr, ca.owner, ca.name, pr.branch)
+		if err != nil {
+			return errors.Wrap(err, "couldn't name namespace")
+		}
+		ns = &v1.Namespace{
 			ObjectMeta: metav1.ObjectMeta{
-				Name: namespace, Annotations: map[string]string{
-					annotation: "true",
-				},
+				Name:        name,
+				Annotations: webhook.annotations(),
+				Labels:      webhook.labels(ca.pr),
 			},
 		}
-		if err := webhook.k8s.Create(ctx, &ns); err != nil {
+		if err := webhook.k8s.Create(ctx, ns); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				return errors.Errorf("the namespace %s exists already and isn't the environment of this PR", name)
+			}
 			return err
 		}
 	}
-	keySecretName, err := ca.ensureGitKeySecret(ctx, webhook)
+	namespace := ns.Name
+	if err := webhook.setUpNamespace(ctx, namespace); err != nil {
+		return errors.Wrap(err, "couldn't set up namespace")
+	}
+	ref := pr.branch
+	var auth, keySecretName string
+	repoURL := webhook.provider.gitURL(ca.owner, ca.name)
+	switch {
+	case pr.fork != nil:
+		repoURL, keySecretName, err = ca.forkSource(ctx, webhook, pr.fork)
+	case webhook.tokenAuth():
+		auth = deployv1alpha1.TokenAuth
+	default:
+		keySecretName, err = ca.ensureGitKeySecret(ctx, webhook)
+		err = errors.Wrap(err, "error ensuring git deploy key secret exists")
+	}
 	if err != nil {
-		return errors.Wrap(err, "error ensuring git deploy key secret exists")
+		return err
 	}
 	refRelease := deployv1alpha1.RefRelease{
-		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		ObjectMeta: metav1.ObjectMeta{Name: releaseName, Namespace: namespace},
 		Spec: deployv1alpha1.RefReleaseSpec{
 			Repo: deployv1alpha1.Repo{
 				Owner:         ca.owner,
 				Name:          ca.name,
 				KeySecretName: keySecretName,
+				URL:           repoURL,
+				Auth:          auth,
 			},
 			Ref: deployv1alpha1.Ref{
-				Sha:         pr.GetHead().GetSHA(),
+				Sha:         pr.sha,
 				Branch:      ref,
 				PullRequest: ca.pr.number,
+				Pinned:      webhook.pinned(pr.fork != nil),
 			},
+			Path:   ca.path,
+			Expiry: webhook.expiry(ca.ttl),
 		},
 	}
 	ghDeployment := deployv1alpha1.GithubDeployment{
-		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		ObjectMeta: metav1.ObjectMeta{Name: releaseName, Namespace: namespace},
 		Spec: deployv1alpha1.Deployment{
-			Owner: ca.owner,
-			Name:  ca.name,
-			Ref:   ref,
+			Owner:       ca.owner,
+			Name:        ca.name,
+			Ref:         ref,
+			Sha:         pr.sha,
+			Provider:    ca.pr.provider,
+			PullRequest: ca.pr.number,
 		},
 	}
 	if err := utils.CreateOrReplace(ctx, webhook.k8s, webhook.k8s, &refRelease); err != nil {
 		return err
 	}
-	ns, _ := client.ObjectKeyFromObject(&ghDeployment)
-	if err := webhook.k8s.Get(ctx, ns, &deployv1alpha1.GithubDeployment{}); err != nil {
+	key, _ := client.ObjectKeyFromObject(&ghDeployment)
+	if err := webhook.k8s.Get(ctx, key, &deployv1alpha1.GithubDeployment{}); err != nil {
 		if client.IgnoreNotFound(err) != nil {
 			return err
 		}
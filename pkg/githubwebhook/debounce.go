@@ -0,0 +1,106 @@
+package githubwebhook
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recentActions remembers the last action taken on each PR so that bursts of
+// equivalent actions, like a double posted comment, only run once.
+type recentActions struct {
+	window time.Duration
+	mu     sync.Mutex
+	last   map[string]recentAction
+}
+
+type recentAction struct {
+	fingerprint string
+	at          time.Time
+}
+
+// fingerprint identifies an action by its type and everything it was parsed
+// with, so that commands with different arguments aren't taken as repeats.
+// Actions with an empty fingerprint, like the read only status, are never
+// taken as repeats.
+func fingerprint(a action) string {
+	switch a := a.(type) {
+	case sequence:
+		var fingerprints []string
+		for _, a := range a {
+			if fp := fingerprint(a); fp != "" {
+				fingerprints = append(fingerprints, fp)
+			}
+		}
+		return strings.Join(fingerprints, ", ")
+	case *create:
+		return fmt.Sprintf("create %s %s/%s branch=%s path=%s ttl=%s",
+			prFingerprint(a.pr), a.owner, a.name, a.branch, a.path, a.ttl)
+	case *update:
+		return fmt.Sprintf("update %s %s/%s branch=%s sha=%s fork=%t",
+			prFingerprint(a.pr), a.owner, a.name, a.branch, a.sha, a.fork)
+	case *redeploy:
+		return fmt.Sprintf("redeploy %s %s/%s", prFingerprint(a.pr), a.owner, a.name)
+	case *drop:
+		return fmt.Sprintf("drop %s remember=%t", prFingerprint(a.pr), a.remember)
+	case *restore:
+		return fmt.Sprintf("restore %s", prFingerprint(a.pr))
+	case *extend:
+		return fmt.Sprintf("extend %s ttl=%s", prFingerprint(a.pr), a.ttl)
+	case *cleanup:
+		repos := make([]string, len(a.repos))
+		for i, repo := range a.repos {
+			repos[i] = strconv.FormatInt(repo.GetID(), 10)
+		}
+		return fmt.Sprintf("cleanup installation=%d repos=%s", a.installationID, strings.Join(repos, ","))
+	default:
+		return ""
+	}
+}
+
+func prFingerprint(pr prPointer) string {
+	return fmt.Sprintf("%s%d-%d", pr.prefix(), pr.id, pr.number)
+}
+
+func newRecentActions(window time.Duration) *recentActions {
+	return &recentActions{
+		window: window,
+		last:   map[string]recentAction{},
+	}
+}
+
+// isRepeat tells us whether the last action under key had the same
+// fingerprint and happened within the window.
+func (r *recentActions) isRepeat(key, fp string, now time.Time) bool {
+	if key == "" || fp == "" || r.window <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	last, ok := r.last[key]
+	return ok && last.fingerprint == fp && now.Sub(last.at) < r.window
+}
+
+// record remembers an action that was taken under key.
+func (r *recentActions) record(key, fp string, now time.Time) {
+	if key == "" || fp == "" || r.window <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, last := range r.last {
+		if now.Sub(last.at) >= r.window {
+			delete(r.last, k)
+		}
+	}
+	r.last[key] = recentAction{fp, now}
+}
+
+// forget makes sure the next action under key isn't taken as a repeat.
+func (r *recentActions) forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.last, key)
+}
@@ -0,0 +1,160 @@
+package githubwebhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	gh "github.com/google/go-github/v31/github"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSSHHost = "github.com"
+	// KnownHostsSecret holds the SSH host keys of the git host
+	KnownHostsSecret = "known_hosts"
+)
+
+// Endpoints says where to find GitHub. The zero value is github.com.
+type Endpoints struct {
+	// URL is the web interface, like https://github.example.com
+	URL string
+	// APIURL is the REST API, like https://github.example.com/api/v3/
+	APIURL string
+	// UploadURL is the upload API, like https://github.example.com/api/uploads/
+	UploadURL string
+	// SSHHost is the `host` or `host:port` git clones from over SSH
+	SSHHost string
+	// KnownHosts holds the SSH host keys of SSHHost, if flux doesn't
+	// know them already
+	KnownHosts string
+}
+
+// EnterpriseEndpoints derives the endpoints of a GitHub Enterprise Server
+// from its URL.
+func EnterpriseEndpoints(rawURL string) (Endpoints, error) {
+	u, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return Endpoints{}, errors.Errorf("expected a URL like https://github.example.com, got %q", rawURL)
+	}
+	base := u.String()
+	return Endpoints{
+		URL:       base,
+		APIURL:    base + "/api/v3/",
+		UploadURL: base + "/api/uploads/",
+		SSHHost:   u.Hostname(),
+	}, nil
+}
+
+// IsEnterprise tells us whether we're talking to GitHub Enterprise Server.
+func (e Endpoints) IsEnterprise() bool {
+	return e.APIURL != ""
+}
+
+// NewClient creates a go-github client for these endpoints. Unlike
+// gh.NewEnterpriseClient, it uses APIURL as it is.
+func (e Endpoints) NewClient(httpClient *http.Client) (*gh.Client, error) {
+	cli := gh.NewClient(httpClient)
+	if !e.IsEnterprise() {
+		return cli, nil
+	}
+	uploadURL := e.UploadURL
+	if uploadURL == "" {
+		uploadURL = e.APIURL
+	}
+	var err error
+	if cli.BaseURL, err = url.Parse(withSlash(e.APIURL)); err != nil {
+		return nil, errors.Wrap(err, "invalid API URL")
+	}
+	if cli.UploadURL, err = url.Parse(withSlash(uploadURL)); err != nil {
+		return nil, errors.Wrap(err, "invalid upload URL")
+	}
+	return cli, nil
+}
+
+// GitURL is how flux clones a repository over SSH.
+func (e Endpoints) GitURL(owner, name string) string {
+	host := e.SSHHost
+	if host == "" {
+		host = defaultSSHHost
+	}
+	// The scp-like syntax can't have a port
+	if strings.Contains(host, ":") {
+		return fmt.Sprintf("ssh://git@%s/%s/%s", host, owner, name)
+	}
+	return fmt.Sprintf("git@%s:%s/%s", host, owner, name)
+}
+
+// HTTPSURL is how flux clones a repository over HTTPS.
+func (e Endpoints) HTTPSURL(owner, name string) string {
+	base := e.URL
+	if base == "" {
+		base = "https://github.com"
+	}
+	return fmt.Sprintf("%s/%s/%s.git", base, owner, name)
+}
+
+// withSlash makes sure relative paths are resolved below rawURL.
+func withSlash(rawURL string) string {
+	if !strings.HasSuffix(rawURL, "/") {
+		return rawURL + "/"
+	}
+	return rawURL
+}
+
+func getOptionalSecret(k string) (string, error) {
+	contents, err := GetSecret(k)
+	if os.IsNotExist(errors.Cause(err)) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(contents)), err
+}
+
+// GetEndpoints reads the endpoints from the mounted secrets. Without
+// GITHUB_URL they point to github.com. The API, upload and SSH endpoints of
+// an Enterprise Server can be overridden with GITHUB_API_URL,
+// GITHUB_UPLOAD_URL and GITHUB_SSH_HOST.
+func GetEndpoints() (Endpoints, error) {
+	var endpoints Endpoints
+
+	webURL, err := getOptionalSecret("GITHUB_URL")
+	if err != nil {
+		return Endpoints{}, err
+	}
+	if webURL != "" {
+		if endpoints, err = EnterpriseEndpoints(webURL); err != nil {
+			return Endpoints{}, errors.Wrap(err, "invalid GITHUB_URL")
+		}
+	}
+
+	overrides := map[string]*string{
+		"GITHUB_API_URL":    &endpoints.APIURL,
+		"GITHUB_UPLOAD_URL": &endpoints.UploadURL,
+		"GITHUB_SSH_HOST":   &endpoints.SSHHost,
+	}
+	for k, field := range overrides {
+		value, err := getOptionalSecret(k)
+		if err != nil {
+			return Endpoints{}, err
+		}
+		if value != "" {
+			*field = value
+		}
+	}
+	// Overrides are used as they are, e.g. for a proxy in front of the API
+	if endpoints.APIURL != "" {
+		endpoints.APIURL = withSlash(endpoints.APIURL)
+	}
+
+	knownHosts, err := getOptionalSecret(KnownHostsSecret)
+	if err != nil {
+		return Endpoints{}, err
+	}
+	if knownHosts != "" {
+		endpoints.KnownHosts = knownHosts + "\n"
+	}
+
+	return endpoints, nil
+}
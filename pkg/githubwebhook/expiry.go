@@ -0,0 +1,99 @@
+package githubwebhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// expiry of an environment deployed now, ttl overriding the default TTL if
+// not 0. Nil if it never expires.
+func (webhook *WebhookHandler) expiry(ttl time.Duration) *deployv1alpha1.Expiry {
+	if ttl == 0 {
+		ttl = webhook.config.TTL
+	}
+
+	if ttl == 0 && webhook.config.IdleTTL == 0 {
+		return nil
+	}
+
+	now := metav1.Now()
+	expiry := &deployv1alpha1.Expiry{ExtendedAt: &now}
+
+	if ttl > 0 {
+		expiry.TTL = &metav1.Duration{Duration: ttl}
+	}
+
+	if webhook.config.IdleTTL > 0 {
+		expiry.Idle = &metav1.Duration{Duration: webhook.config.IdleTTL}
+	}
+
+	return expiry
+}
+
+// extend pushes back the expiry of an environment.
+type extend struct {
+	pr prPointer
+	// ttl replaces the TTL of the environment if not 0
+	ttl     time.Duration
+	details string
+}
+
+func (e *extend) Act(webhook *WebhookHandler) error {
+	ctx := context.Background()
+	ns, err := webhook.environment(ctx, e.pr)
+	if err != nil {
+		return err
+	}
+	if ns == nil {
+		return errors.New("there's no environment to extend, deploy it first")
+	}
+
+	var refRelease deployv1alpha1.RefRelease
+	nn := types.NamespacedName{Name: releaseName, Namespace: ns.Name}
+	if err := webhook.k8s.Get(ctx, nn, &refRelease); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		return errors.New("there's no environment to extend, deploy it first")
+	}
+
+	expiry := refRelease.Spec.Expiry
+	if expiry == nil {
+		if e.ttl == 0 {
+			e.details = "This environment doesn't expire."
+			return nil
+		}
+		expiry = &deployv1alpha1.Expiry{}
+		refRelease.Spec.Expiry = expiry
+	}
+
+	now := metav1.Now()
+	expiry.ExtendedAt = &now
+	if e.ttl > 0 {
+		expiry.TTL = &metav1.Duration{Duration: e.ttl}
+	}
+	if err := webhook.k8s.Update(ctx, &refRelease); err != nil {
+		return errors.Wrap(err, "couldn't update RefRelease")
+	}
+
+	if expires, ok := refRelease.ExpiresAt(); ok {
+		e.details = fmt.Sprintf("The environment now expires at %s.", expires.UTC().Format(time.RFC1123))
+	}
+
+	return nil
+}
+
+func (e *extend) Describe() string {
+	return fmt.Sprintf("Extending PR %d from %d", e.pr.number, e.pr.id)
+}
+
+func (e *extend) Details() string {
+	return e.details
+}
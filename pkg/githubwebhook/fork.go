@@ -0,0 +1,79 @@
+package githubwebhook
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Policies for PRs from forks
+const (
+	// ForksDeny never deploys PRs from forks
+	ForksDeny = "deny"
+	// ForksApprove deploys commits of PRs from forks once someone with write
+	// permission approved them
+	ForksApprove = "approve"
+	// ForksAllow deploys PRs from forks like any other
+	ForksAllow = "allow"
+)
+
+// ParseForkPolicy checks a policy for PRs from forks.
+func ParseForkPolicy(raw string) (string, error) {
+	switch raw {
+	case ForksDeny, ForksApprove, ForksAllow:
+		return raw, nil
+	default:
+		return "", errors.Errorf("expected %s, %s or %s, got %q", ForksDeny, ForksApprove, ForksAllow, raw)
+	}
+}
+
+// checkFork makes sure sha of a PR from a fork may be deployed.
+func (webhook *WebhookHandler) checkFork(ctx context.Context, owner, name string, number int, sha string) error {
+	switch webhook.config.Forks {
+	case ForksAllow:
+		return nil
+	case ForksApprove:
+		approved, err := webhook.provider.approved(ctx, owner, name, number, sha)
+		if err != nil {
+			return errors.Wrap(err, "couldn't check approvals")
+		}
+		if !approved {
+			return errors.Errorf("PRs from forks need an approving review of %s by someone with write permission", sha)
+		}
+		return nil
+	default:
+		return errors.New("PRs from forks can't be deployed here")
+	}
+}
+
+// pinned tells us whether flux has to stay at the approved commit of a PR
+// rather than follow its branch, which anyone with access to the fork can push
+// to.
+func (webhook *WebhookHandler) pinned(fork bool) bool {
+	return fork && webhook.config.Forks == ForksApprove
+}
+
+// forkSource is where flux clones a fork from, along with the secret holding
+// its deploy key. Public forks are cloned anonymously so only private forks
+// need a key.
+func (ca *create) forkSource(ctx context.Context, webhook *WebhookHandler, fork *forkRepo) (string, string, error) {
+	if !fork.private {
+		return fork.httpsURL, "", nil
+	}
+	// Our installation tokens can't read repos we're not installed on
+	if webhook.tokenAuth() {
+		return "", "", errors.Errorf("the private fork %s/%s can only be cloned with deploy keys", fork.owner, fork.name)
+	}
+	forkPR := prPointer{provider: ca.pr.provider, id: fork.id}
+	forkKeySecretName := forkPR.keySecretName()
+	err := ensureKeySecret(
+		ctx, webhook, forkKeySecretName, ca.pr.provider, fork.owner, fork.name,
+		func(key []byte) (int64, error) {
+			return webhook.provider.addForkDeployKey(ctx, fork, key)
+		},
+	)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "couldn't set up a deploy key for the fork %s/%s", fork.owner, fork.name)
+	}
+	return fork.sshURL, forkKeySecretName, nil
+}
@@ -0,0 +1,332 @@
+package githubwebhook
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"github.com/pkg/errors"
+)
+
+// gitlabProvider acts as the user owning a GitLab access token.
+type gitlabProvider struct {
+	cli *gitlab.Client
+}
+
+// projectPath splits the path of a GitLab project into the namespace it's in
+// and its name.
+func projectPath(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+func project(owner, name string) string {
+	return gitlab.Project(owner + "/" + name)
+}
+
+func (p *gitlabProvider) pullRequest(ctx context.Context, owner, name string, number int) (pullRequest, error) {
+	mr, err := p.cli.MergeRequest(ctx, project(owner, name), number)
+	if err != nil {
+		return pullRequest{}, err
+	}
+	found := pullRequest{branch: mr.SourceBranch, sha: mr.SHA}
+	if mr.SourceProjectID != mr.TargetProjectID {
+		source, err := p.cli.GetProject(ctx, gitlab.ProjectID(mr.SourceProjectID))
+		if err != nil {
+			return pullRequest{}, errors.Wrap(err, "couldn't get the project of the merge request")
+		}
+		forkOwner, forkName := projectPath(source.PathWithNamespace)
+		found.fork = &forkRepo{
+			owner:    forkOwner,
+			name:     forkName,
+			id:       source.ID,
+			private:  source.Visibility != "public",
+			httpsURL: source.HTTPURLToRepo,
+			sshURL:   p.cli.GitURL(source.PathWithNamespace),
+		}
+	}
+	return found, nil
+}
+
+func (p *gitlabProvider) addDeployKey(ctx context.Context, owner, name string, key []byte) (int64, error) {
+	deployKey, err := p.cli.AddDeployKey(ctx, project(owner, name), properator, string(key))
+	if err != nil {
+		return 0, err
+	}
+	return deployKey.ID, nil
+}
+
+// addForkDeployKey needs our user to be a maintainer of the fork.
+func (p *gitlabProvider) addForkDeployKey(ctx context.Context, fork *forkRepo, key []byte) (int64, error) {
+	return p.addDeployKey(ctx, fork.owner, fork.name, key)
+}
+
+// approved only counts approvals that cover sha, the head of the merge
+// request. That's any approval if the project resets approvals on push,
+// otherwise only those given after sha was pushed.
+func (p *gitlabProvider) approved(ctx context.Context, owner, name string, number int, sha string) (bool, error) {
+	mr, err := p.cli.MergeRequest(ctx, project(owner, name), number)
+	if err != nil {
+		return false, err
+	}
+	if mr.SHA != sha {
+		// Approvals are of the merge request, so they can't cover older commits
+		return false, nil
+	}
+
+	info, err := p.cli.GetProject(ctx, project(owner, name))
+	if err != nil {
+		return false, err
+	}
+	resets := info.ResetApprovalsOnPush != nil && *info.ResetApprovalsOnPush
+
+	var pushedAt time.Time
+	if !resets {
+		if pushedAt, err = p.pushedAt(ctx, owner, name, number, sha); err != nil || pushedAt.IsZero() {
+			return false, err
+		}
+	}
+
+	approvals, err := p.cli.Approvals(ctx, project(owner, name), number)
+	if err != nil {
+		return false, err
+	}
+	for _, approval := range approvals.ApprovedBy {
+		if !resets && (approval.ApprovedAt == nil || !approval.ApprovedAt.After(pushedAt)) {
+			continue
+		}
+		level, err := p.permission(ctx, owner, name, approval.User.Username)
+		if err != nil {
+			return false, err
+		}
+		if permissionRanks[level] >= permissionRanks["write"] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// pushedAt is when sha last became the head of a merge request, zero if it
+// never did. Commit dates are up to whoever pushed them, so we go by when
+// GitLab saw the push.
+func (p *gitlabProvider) pushedAt(ctx context.Context, owner, name string, number int, sha string) (time.Time, error) {
+	versions, err := p.cli.MergeRequestVersions(ctx, project(owner, name), number)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var pushedAt time.Time
+	for _, version := range versions {
+		if version.HeadCommitSHA == sha && version.CreatedAt.After(pushedAt) {
+			pushedAt = version.CreatedAt
+		}
+	}
+	return pushedAt, nil
+}
+
+// accessPermission maps GitLab access levels to GitHub permissions.
+func accessPermission(member *gitlab.Member) string {
+	if member.State != "active" {
+		return "none"
+	}
+	switch {
+	case member.AccessLevel >= gitlab.MaintainerAccess:
+		return "admin"
+	case member.AccessLevel >= gitlab.DeveloperAccess:
+		return "write"
+	case member.AccessLevel >= gitlab.ReporterAccess:
+		return "read"
+	default:
+		return "none"
+	}
+}
+
+func (p *gitlabProvider) permission(ctx context.Context, owner, name, user string) (string, error) {
+	u, err := p.cli.UserByName(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	member, err := p.cli.ProjectMember(ctx, project(owner, name), u.ID)
+	if gitlab.IsNotFound(err) {
+		return "none", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return accessPermission(member), nil
+}
+
+// isTeamMember treats teams as paths of GitLab groups.
+func (p *gitlabProvider) isTeamMember(ctx context.Context, user string, teams []string) (bool, error) {
+	u, err := p.cli.UserByName(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	for _, team := range teams {
+		member, err := p.cli.GroupMember(ctx, team, u.ID)
+		if gitlab.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "couldn't get membership of %s in %s", user, team)
+		}
+		if member.State == "active" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (p *gitlabProvider) react(ctx context.Context, owner, name string, number int, id int64, reaction string) error {
+	return p.cli.AwardEmoji(ctx, project(owner, name), number, id, reaction)
+}
+
+func (p *gitlabProvider) comment(ctx context.Context, owner, name string, number int, body string) (int64, error) {
+	note, err := p.cli.CreateNote(ctx, project(owner, name), number, body)
+	if err != nil {
+		return 0, err
+	}
+	return note.ID, nil
+}
+
+func (p *gitlabProvider) editComment(ctx context.Context, owner, name string, number int, id int64, body string) error {
+	return p.cli.EditNote(ctx, project(owner, name), number, id, body)
+}
+
+func (p *gitlabProvider) gitURL(owner, name string) string {
+	return p.cli.GitURL(owner + "/" + name)
+}
+
+// noteTrigger ignores updated notes. Older GitLab versions only send new ones
+// and leave out the action.
+func noteTrigger(note *gitlab.NoteEvent) (trigger, bool) {
+	if action := note.ObjectAttributes.Action; action != "" && action != "create" {
+		return trigger{}, false
+	}
+	if note.ObjectAttributes.NoteableType != "MergeRequest" || note.MergeRequest == nil {
+		return trigger{}, false
+	}
+	owner, name := projectPath(note.Project.PathWithNamespace)
+	return trigger{
+		owner: owner,
+		repo:  name,
+		pr: prPointer{
+			provider: deployv1alpha1.GitlabProvider,
+			id:       note.Project.ID,
+			number:   note.MergeRequest.IID,
+		},
+		id:   note.ObjectAttributes.ID,
+		user: note.User.Username,
+	}, true
+}
+
+func parseNote(username string, note *gitlab.NoteEvent, authorize authorizer) (action, error) {
+	t, ok := noteTrigger(note)
+	if !ok {
+		return nil, nil
+	}
+	return parseCommandActions(username, note.ObjectAttributes.Note, t.owner, t.repo, t.pr, authorize)
+}
+
+func parseMergeRequestEvent(event *gitlab.MergeRequestEvent, config *Config) action {
+	mr := event.ObjectAttributes
+	pr := prPointer{
+		provider: deployv1alpha1.GitlabProvider,
+		id:       event.Project.ID,
+		number:   mr.IID,
+	}
+	owner, name := projectPath(event.Project.PathWithNamespace)
+	switch mr.Action {
+	case "open":
+		if config.DeployLabel == "" || !event.HasLabel(config.DeployLabel) {
+			return nil
+		}
+		return &create{owner: owner, name: name, pr: pr}
+	case "close":
+		return &drop{pr: pr, remember: true}
+	case "merge":
+		// Merged MRs can't be reopened
+		return &drop{pr: pr}
+	case "reopen":
+		return &restore{pr: pr}
+	case "update":
+		if added, removed := event.LabelChanged(config.DeployLabel); config.DeployLabel != "" && mr.State == "opened" {
+			if removed {
+				return &drop{pr: pr}
+			}
+			if added {
+				return &create{owner: owner, name: name, pr: pr}
+			}
+		}
+		if mr.OldRev == "" {
+			return nil
+		}
+		return &update{
+			owner:  owner,
+			name:   name,
+			sha:    mr.LastCommit.ID,
+			branch: mr.SourceBranch,
+			pr:     pr,
+			fork:   mr.SourceProjectID != mr.TargetProjectID,
+		}
+	default:
+		return nil
+	}
+}
+
+// gitlabWebhook receives events from GitLab project or group webhooks.
+type gitlabWebhook struct {
+	token   []byte
+	webhook *Webhook
+}
+
+// NewGitlabWebhook receives GitLab events, checking they were sent with
+// token, and queues them like webhook does.
+func NewGitlabWebhook(token []byte, webhook *Webhook) http.Handler {
+	return &gitlabWebhook{token, webhook}
+}
+
+func (g *gitlabWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, err := gitlab.ValidatePayload(r, g.token)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	eventType := gitlab.WebHookType(r)
+	if eventType == "" {
+		// GitLab disables webhooks that keep failing
+		return
+	}
+
+	g.webhook.receive(w, r, Event{
+		Type:       eventType,
+		DeliveryID: gitlab.DeliveryID(r),
+		ReceivedAt: time.Now(),
+		Payload:    payload,
+	})
+}
+
+// SetupGitlab creates a GitLab client from the GITLAB_URL, GITLAB_TOKEN and
+// optional GITLAB_SSH_HOST secrets. It returns nil without GITLAB_URL.
+func SetupGitlab() (*gitlab.Client, error) {
+	baseURL, err := getOptionalSecret("GITLAB_URL")
+	if err != nil || baseURL == "" {
+		return nil, err
+	}
+	token, err := GetSecret("GITLAB_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	sshHost, err := getOptionalSecret("GITLAB_SSH_HOST")
+	if err != nil {
+		return nil, err
+	}
+	cli, err := gitlab.NewClient(baseURL, strings.TrimSpace(string(token)), sshHost)
+	return cli, errors.Wrap(err, "invalid GITLAB_URL")
+}
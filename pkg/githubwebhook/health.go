@@ -0,0 +1,80 @@
+package githubwebhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	gh "github.com/google/go-github/v31/github"
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// checkTimeout is how long a single readiness check may take.
+const checkTimeout = 5 * time.Second
+
+// Check tells us whether something we depend on is usable.
+type Check func(ctx context.Context) error
+
+// GithubCheck makes sure we can still authenticate as the app.
+func GithubCheck(app *gh.Client) Check {
+	return func(ctx context.Context) error {
+		_, _, err := app.Apps.Get(ctx, "")
+		return errors.Wrap(err, "couldn't authenticate as app")
+	}
+}
+
+// GitlabCheck makes sure our GitLab token works.
+func GitlabCheck(cli *gitlab.Client) Check {
+	return func(ctx context.Context) error {
+		_, err := cli.CurrentUser(ctx)
+		return errors.Wrap(err, "couldn't authenticate with GitLab")
+	}
+}
+
+// KubernetesCheck makes sure we can reach the API server and read events.
+func KubernetesCheck(k8s client.Client, namespace string) Check {
+	return func(ctx context.Context) error {
+		var events deployv1alpha1.WebhookEventList
+		err := k8s.List(ctx, &events, client.InNamespace(namespace), client.Limit(1))
+		return errors.Wrap(err, "couldn't list stored events")
+	}
+}
+
+// Healthz reports that the server is up.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// Readyz reports whether every check passes.
+func Readyz(checks map[string]Check) http.Handler {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		defer cancel()
+
+		var failed []string
+		for _, name := range names {
+			if err := checks[name](ctx); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", name, err))
+			}
+		}
+
+		if len(failed) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(failed, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -1,22 +1,71 @@
 package githubwebhook
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 )
 
+// Types of deploy keys
+const (
+	KeyRSA     = "rsa"
+	KeyEd25519 = "ed25519"
+)
+
+// Deploy key secrets are labeled and annotated so their keys can be managed.
+const (
+	// SecretLabel marks every secret properator manages, the manager only
+	// watches those. Its value says what the secret holds.
+	SecretLabel = "deploy.properator.io/secret"
+	// DeployKeySecret is the SecretLabel of secrets holding a deploy key
+	DeployKeySecret = "deploy-key"
+	// DeployKeyLabel marks secrets holding a deploy key
+	DeployKeyLabel = "deploy.properator.io/deploy-key"
+	// KeyRepoAnnotation is the owner/name of the repo a key was added to
+	KeyRepoAnnotation = "deploy.properator.io/repo"
+	// KeyProviderAnnotation is empty for GitHub
+	KeyProviderAnnotation = "deploy.properator.io/provider"
+	// KeyIDAnnotation is the ID of the key on the repo
+	KeyIDAnnotation = "deploy.properator.io/key-id"
+)
+
 // RawKeyPair can be written to disk.
 type RawKeyPair struct {
 	Public  []byte
 	Private []byte
 }
 
-// generateKey creates an RSA keypair ready to write to disk.
-func generateKey() (RawKeyPair, error) {
+// ParseKeyType checks a type of deploy key.
+func ParseKeyType(raw string) (string, error) {
+	switch raw {
+	case KeyRSA, KeyEd25519:
+		return raw, nil
+	default:
+		return "", errors.Errorf("expected %s or %s, got %q", KeyRSA, KeyEd25519, raw)
+	}
+}
+
+// GenerateKey creates a keypair of keyType ready to write to disk, RSA if
+// keyType is empty.
+func GenerateKey(keyType string) (RawKeyPair, error) {
+	switch keyType {
+	case "", KeyRSA:
+		return generateRSAKey()
+	case KeyEd25519:
+		return generateEd25519Key()
+	default:
+		return RawKeyPair{}, errors.Errorf("unknown key type %q", keyType)
+	}
+}
+
+// generateRSAKey creates an RSA keypair ready to write to disk.
+func generateRSAKey() (RawKeyPair, error) {
 	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return RawKeyPair{}, err
@@ -39,3 +88,64 @@ func generateKey() (RawKeyPair, error) {
 		Private: pem.EncodeToMemory(&priv),
 	}, nil
 }
+
+// generateEd25519Key creates an ed25519 keypair ready to write to disk.
+func generateEd25519Key() (RawKeyPair, error) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return RawKeyPair{}, err
+	}
+
+	pub, err := ssh.NewPublicKey(edPub)
+	if err != nil {
+		return RawKeyPair{}, err
+	}
+
+	priv, err := marshalEd25519PrivateKey(edPriv, pub)
+	if err != nil {
+		return RawKeyPair{}, err
+	}
+
+	return RawKeyPair{
+		Public:  ssh.MarshalAuthorizedKey(pub),
+		Private: pem.EncodeToMemory(priv),
+	}, nil
+}
+
+// marshalEd25519PrivateKey encodes an unencrypted key in the OpenSSH format,
+// the only one ssh reads ed25519 keys from.
+func marshalEd25519PrivateKey(key ed25519.PrivateKey, pub ssh.PublicKey) (*pem.Block, error) {
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+
+	checkInt := binary.BigEndian.Uint32(check[:])
+	private := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{checkInt, checkInt, ssh.KeyAlgoED25519, []byte(key.Public().(ed25519.PublicKey)), []byte(key), ""})
+
+	// Pad to the block size of the "none" cipher
+	for i := byte(1); len(private)%8 != 0; i++ {
+		private = append(private, i)
+	}
+
+	body := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, pub.Marshal(), private})
+
+	return &pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), body...),
+	}, nil
+}
@@ -0,0 +1,123 @@
+package githubwebhook
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	gh "github.com/google/go-github/v31/github"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	eventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "properator_webhook_events_total",
+		Help: "Number of webhook events handled by type and resulting action.",
+	}, []string{"type", "action"})
+	actionErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "properator_webhook_action_errors_total",
+		Help: "Number of actions that failed, after retrying transient errors.",
+	}, []string{"action", "transient"})
+	actionRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "properator_webhook_action_retries_total",
+		Help: "Number of times actions were retried after transient errors.",
+	}, []string{"action"})
+	actionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "properator_webhook_action_duration_seconds",
+		Help:    "How long actions took, including retries.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"action"})
+	deadLettersTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "properator_webhook_dead_letters_total",
+		Help: "Number of events that were given up on.",
+	})
+
+	githubRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "properator_github_requests_total",
+		Help: "Number of GitHub API requests by client and status code.",
+	}, []string{"client", "code"})
+	githubRateLimitRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "properator_github_rate_limit_remaining",
+		Help: "Remaining GitHub API requests in the current rate limit window.",
+	}, []string{"client"})
+)
+
+// Collectors are the metrics of the webhook server and its workers.
+func Collectors() []prometheus.Collector {
+	return append([]prometheus.Collector{
+		eventsTotal, actionErrorsTotal, actionRetriesTotal, actionDuration, deadLettersTotal,
+	}, GithubCollectors()...)
+}
+
+// GithubCollectors are the metrics of GitHub API calls made through
+// clients from `SetupGhCli`.
+func GithubCollectors() []prometheus.Collector {
+	return []prometheus.Collector{githubRequestsTotal, githubRateLimitRemaining}
+}
+
+// DepthGauge reports the number of waiting events.
+func (p *Pool) DepthGauge() prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "properator_webhook_queue_depth",
+		Help: "Number of events waiting to be handled.",
+	}, func() float64 {
+		return float64(p.Depth())
+	})
+}
+
+// eventType is the X-GitHub-Event of an event we handle.
+func eventType(event interface{}) string {
+	switch event.(type) {
+	case *gh.IssueCommentEvent:
+		return "issue_comment"
+	case *gh.PullRequestEvent:
+		return "pull_request"
+	case *gh.InstallationEvent:
+		return "installation"
+	case *gh.InstallationRepositoriesEvent:
+		return "installation_repositories"
+	case *gitlab.NoteEvent:
+		return gitlab.NoteHook
+	case *gitlab.MergeRequestEvent:
+		return gitlab.MergeRequestHook
+	default:
+		return "unknown"
+	}
+}
+
+// actionName is a short name for the kind of action, like `create`.
+func actionName(a action) string {
+	if a == nil {
+		return "none"
+	}
+	if s, ok := a.(sequence); ok {
+		names := make([]string, 0, len(s))
+		for _, a := range s {
+			names = append(names, actionName(a))
+		}
+		return strings.Join(names, "+")
+	}
+	return strings.TrimSuffix(reflect.Indirect(reflect.ValueOf(a)).Type().Name(), "Action")
+}
+
+// instrumentedTransport counts GitHub API requests and keeps track of the
+// rate limit.
+type instrumentedTransport struct {
+	next   http.RoundTripper
+	client string
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		githubRequestsTotal.WithLabelValues(t.client, "error").Inc()
+		return resp, err
+	}
+	githubRequestsTotal.WithLabelValues(t.client, strconv.Itoa(resp.StatusCode)).Inc()
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		githubRateLimitRemaining.WithLabelValues(t.client).Set(float64(remaining))
+	}
+	return resp, nil
+}
@@ -0,0 +1,259 @@
+package githubwebhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/michaelbeaumont/properator/pkg/utils"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// +kubebuilder:rbac:groups=core,resources=resourcequotas;limitranges,verbs=get;create;update
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;create;update
+
+// releaseName is the name of the RefRelease and GithubDeployment in each
+// environment namespace.
+const releaseName = "github-webhook"
+
+// environmentObjectName is the name of the objects we add from the
+// NamespaceConfig to each environment namespace.
+const environmentObjectName = "properator"
+
+// NamespaceConfig says how the namespaces of environments are set up.
+type NamespaceConfig struct {
+	// NameTemplate is a text/template given NamespaceValues. Its output is
+	// turned into a DNS label. If empty, namespaces are named after the IDs of
+	// the repo and PR.
+	NameTemplate  string                          `json:"nameTemplate,omitempty"`
+	Labels        map[string]string               `json:"labels,omitempty"`
+	Annotations   map[string]string               `json:"annotations,omitempty"`
+	ResourceQuota *v1.ResourceQuotaSpec           `json:"resourceQuota,omitempty"`
+	LimitRange    *v1.LimitRangeSpec              `json:"limitRange,omitempty"`
+	NetworkPolicy *networkingv1.NetworkPolicySpec `json:"networkPolicy,omitempty"`
+
+	nameTemplate *template.Template
+}
+
+// NamespaceValues are available to NamespaceConfig.NameTemplate.
+type NamespaceValues struct {
+	Owner  string
+	Repo   string
+	Number int
+	Branch string
+	// Provider is empty for GitHub
+	Provider string
+	ID       int64
+}
+
+// ParseNamespaceConfig parses a NamespaceConfig from YAML or JSON.
+func ParseNamespaceConfig(raw []byte) (*NamespaceConfig, error) {
+	var config NamespaceConfig
+	if err := yaml.UnmarshalStrict(raw, &config); err != nil {
+		return nil, err
+	}
+
+	if config.NameTemplate != "" {
+		tmpl, err := template.New("namespace").Option("missingkey=error").Parse(config.NameTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid nameTemplate")
+		}
+		config.nameTemplate = tmpl
+
+		if _, err := config.name(NamespaceValues{Owner: "owner", Repo: "repo", Number: 1, Branch: "branch"}); err != nil {
+			return nil, errors.Wrap(err, "invalid nameTemplate")
+		}
+	}
+
+	for key, value := range config.Labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, errors.Errorf("invalid label %q: %s", key, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return nil, errors.Errorf("invalid value of label %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+
+	return &config, nil
+}
+
+// LoadNamespaceConfig reads a NamespaceConfig from a file, nil if path is
+// empty.
+func LoadNamespaceConfig(path string) (*NamespaceConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseNamespaceConfig(raw)
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// hashLength is how much of the hash truncated names end with.
+const hashLength = 8
+
+// dnsLabel turns a name into a valid namespace name. Long names are truncated
+// and get a hash of the whole name so they stay apart.
+func dnsLabel(name string) string {
+	label := strings.Trim(invalidLabelChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(label) <= validation.DNS1123LabelMaxLength {
+		return label
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	prefix := strings.TrimRight(label[:validation.DNS1123LabelMaxLength-hashLength-1], "-")
+
+	return prefix + "-" + hex.EncodeToString(sum[:])[:hashLength]
+}
+
+// name renders the namespace name of an environment.
+func (config *NamespaceConfig) name(values NamespaceValues) (string, error) {
+	var b bytes.Buffer
+	if err := config.nameTemplate.Execute(&b, values); err != nil {
+		return "", err
+	}
+
+	name := dnsLabel(b.String())
+	if name == "" {
+		return "", errors.Errorf("nameTemplate gives an empty name for %v", values)
+	}
+
+	return name, nil
+}
+
+// namespaceName is the namespace we create for a new environment of pr.
+func (webhook *WebhookHandler) namespaceName(pr prPointer, owner, repo, branch string) (string, error) {
+	config := webhook.config.Namespaces
+	if config == nil || config.nameTemplate == nil {
+		return pr.defaultNamespace(), nil
+	}
+
+	return config.name(NamespaceValues{
+		Owner: owner, Repo: repo, Number: pr.number, Branch: branch, Provider: pr.provider, ID: pr.id,
+	})
+}
+
+// environment finds the namespace of the environment of pr, nil if it doesn't
+// have one.
+func (webhook *WebhookHandler) environment(ctx context.Context, pr prPointer) (*v1.Namespace, error) {
+	var namespaces v1.NamespaceList
+	if err := webhook.k8s.List(ctx, &namespaces, client.MatchingLabels{
+		repoLabel:        strconv.FormatInt(pr.id, 10),
+		pullRequestLabel: strconv.Itoa(pr.number),
+	}); err != nil {
+		return nil, errors.Wrap(err, "couldn't list namespaces")
+	}
+
+	for i := range namespaces.Items {
+		ns := &namespaces.Items[i]
+		if _, ok := ns.Annotations[EnvironmentAnnotation]; ok && ns.Labels[providerLabel] == pr.provider {
+			return ns, nil
+		}
+	}
+
+	// Environments from before we labeled them
+	var ns v1.Namespace
+	if err := webhook.k8s.Get(ctx, types.NamespacedName{Name: pr.defaultNamespace()}, &ns); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+
+	if _, ok := ns.Annotations[EnvironmentAnnotation]; !ok {
+		// We don't own this ns apparently
+		return nil, nil
+	}
+
+	return &ns, nil
+}
+
+// labels are set on new environment namespaces, after those of the
+// NamespaceConfig.
+func (webhook *WebhookHandler) labels(pr prPointer) map[string]string {
+	labels := map[string]string{}
+	if config := webhook.config.Namespaces; config != nil {
+		for key, value := range config.Labels {
+			labels[key] = value
+		}
+	}
+
+	labels[repoLabel] = strconv.FormatInt(pr.id, 10)
+	labels[pullRequestLabel] = strconv.Itoa(pr.number)
+
+	if pr.provider != "" {
+		labels[providerLabel] = pr.provider
+	} else {
+		labels[installationLabel] = strconv.FormatInt(webhook.installationID, 10)
+	}
+
+	return labels
+}
+
+// annotations are set on new environment namespaces, after those of the
+// NamespaceConfig.
+func (webhook *WebhookHandler) annotations() map[string]string {
+	annotations := map[string]string{}
+	if config := webhook.config.Namespaces; config != nil {
+		for key, value := range config.Annotations {
+			annotations[key] = value
+		}
+	}
+
+	annotations[EnvironmentAnnotation] = "true"
+
+	return annotations
+}
+
+// environmentObjects are what the NamespaceConfig adds to the environment
+// namespace.
+func (config *NamespaceConfig) environmentObjects(namespace string) []runtime.Object {
+	if config == nil {
+		return nil
+	}
+
+	meta := metav1.ObjectMeta{Name: environmentObjectName, Namespace: namespace}
+
+	var objects []runtime.Object
+	if config.ResourceQuota != nil {
+		objects = append(objects, &v1.ResourceQuota{ObjectMeta: meta, Spec: *config.ResourceQuota.DeepCopy()})
+	}
+
+	if config.LimitRange != nil {
+		objects = append(objects, &v1.LimitRange{ObjectMeta: meta, Spec: *config.LimitRange.DeepCopy()})
+	}
+
+	if config.NetworkPolicy != nil {
+		objects = append(objects, &networkingv1.NetworkPolicy{ObjectMeta: meta, Spec: *config.NetworkPolicy.DeepCopy()})
+	}
+
+	return objects
+}
+
+// setUpNamespace applies the objects of the NamespaceConfig to an
+// environment namespace, so changes to it reach environments on deploy.
+func (webhook *WebhookHandler) setUpNamespace(ctx context.Context, namespace string) error {
+	for _, obj := range webhook.config.Namespaces.environmentObjects(namespace) {
+		if err := utils.CreateOrReplace(ctx, webhook.k8s, webhook.k8s, obj); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
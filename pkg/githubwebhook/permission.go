@@ -0,0 +1,79 @@
+package githubwebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// permissionRanks orders the permissions GitHub reports for collaborators.
+var permissionRanks = map[string]int{
+	"none":  0,
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
+// permissionError is returned when a commenter isn't allowed to use a command.
+type permissionError struct {
+	user   string
+	verb   string
+	reason string
+}
+
+func (e *permissionError) Error() string {
+	return fmt.Sprintf("@%s can't use %s: %s", e.user, e.verb, e.reason)
+}
+
+// authorizer checks whether a command may be acted upon.
+type authorizer func(cmd command) error
+
+// authorize checks commands against the permissions of the commenter.
+// The provider is only asked once per comment.
+func (webhook *WebhookHandler) authorize(ctx context.Context, t trigger) authorizer {
+	var (
+		level    *string
+		isMember *bool
+	)
+
+	return func(cmd command) error {
+		required, ok := webhook.config.Permissions[cmd.verb()]
+		if !ok {
+			required = "write"
+		}
+
+		if level == nil {
+			l, err := webhook.provider.permission(ctx, t.owner, t.repo, t.user)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't get permission level of %s", t.user)
+			}
+			level = &l
+		}
+
+		if permissionRanks[*level] < permissionRanks[required] {
+			return &permissionError{t.user, cmd.verb(), fmt.Sprintf("%s permission is needed", required)}
+		}
+
+		if len(webhook.config.Teams) == 0 || permissionRanks[required] <= permissionRanks["read"] {
+			return nil
+		}
+
+		if isMember == nil {
+			member, err := webhook.provider.isTeamMember(ctx, t.user, webhook.config.Teams)
+			if err != nil {
+				return err
+			}
+			isMember = &member
+		}
+
+		if !*isMember {
+			return &permissionError{
+				t.user, cmd.verb(), fmt.Sprintf("membership in one of %s is needed", strings.Join(webhook.config.Teams, ", ")),
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,283 @@
+package githubwebhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	gh "github.com/google/go-github/v31/github"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"github.com/pkg/errors"
+)
+
+// eventKey groups events that must be handled in order.
+func eventKey(event interface{}) string {
+	switch event := event.(type) {
+	case *gh.IssueCommentEvent:
+		return fmt.Sprintf("pr-%d-%d", event.GetRepo().GetID(), event.GetIssue().GetNumber())
+	case *gh.PullRequestEvent:
+		return fmt.Sprintf("pr-%d-%d", event.GetRepo().GetID(), event.GetPullRequest().GetNumber())
+	case *gitlab.NoteEvent:
+		if event.MergeRequest == nil {
+			return ""
+		}
+		return fmt.Sprintf("gitlab-mr-%d-%d", event.Project.ID, event.MergeRequest.IID)
+	case *gitlab.MergeRequestEvent:
+		return fmt.Sprintf("gitlab-mr-%d-%d", event.Project.ID, event.ObjectAttributes.IID)
+	case HasInstallation:
+		return fmt.Sprintf("installation-%d", event.GetInstallation().GetID())
+	default:
+		return ""
+	}
+}
+
+// Pool handles events with several workers. Events with the same key, like
+// those of a PR, are handled one at a time and in order. Events of other keys
+// go to any free worker, so a busy PR never holds them up.
+type Pool struct {
+	worker *WebhookWorker
+	queue  *Queue
+	size   int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// keys holds the events of each key that haven't been handled
+	keys map[string]*keyBacklog
+	// ready are the keys a worker can take an event of, in the order they
+	// became ready
+	ready []string
+	// handling is the number of events workers are busy with
+	handling int
+	// retrying is the number of events waiting to be retried
+	retrying int
+	closed   bool
+}
+
+// keyBacklog holds the events of a key, oldest first.
+type keyBacklog struct {
+	jobs []job
+	// active is set while an event of the key is handled or waits to be
+	// retried
+	active bool
+}
+
+// job is an event or, after a transient error, what's left of handling it.
+type job struct {
+	event Event
+	// retry continues handling event, if set
+	retry func() error
+}
+
+// NewPool creates a pool of size workers.
+func NewPool(worker *WebhookWorker, queue *Queue, size int) *Pool {
+	p := &Pool{worker: worker, queue: queue, size: size, keys: map[string]*keyBacklog{}}
+	p.cond = sync.NewCond(&p.mu)
+
+	return p
+}
+
+// keyFor is the key of a stored event. Events we can't group are handled on
+// their own.
+func keyFor(stored Event) string {
+	var key string
+	if event, err := stored.Parse(); err == nil {
+		key = eventKey(event)
+	}
+
+	if key == "" {
+		return "event-" + stored.ID
+	}
+
+	return key
+}
+
+// Run hands out events from the queue until it's closed and every worker
+// is finished. Events waiting to be retried then are left in the store.
+func (p *Pool) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var workers sync.WaitGroup
+	for i := 0; i < p.size; i++ {
+		workers.Add(1)
+
+		go p.work(&workers)
+	}
+
+	for stored := range p.queue.Events() {
+		p.dispatch(keyFor(stored), job{event: stored})
+	}
+
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	workers.Wait()
+}
+
+func (p *Pool) work(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		key, j, ok := p.take()
+		if !ok {
+			return
+		}
+
+		var err error
+		if j.retry != nil {
+			err = j.retry()
+		} else {
+			err = p.worker.work(j.event)
+		}
+
+		var later *retryLater
+		if errors.As(err, &later) {
+			p.retryLater(key, job{j.event, later.retry}, later.after)
+			continue
+		}
+
+		p.worker.complete(p.queue, j.event, err)
+		p.release(key)
+	}
+}
+
+// dispatch adds a job to the backlog of its key without waiting for a worker.
+func (p *Pool) dispatch(key string, j job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	backlog, ok := p.keys[key]
+	if !ok {
+		backlog = &keyBacklog{}
+		p.keys[key] = backlog
+	}
+
+	backlog.jobs = append(backlog.jobs, j)
+	if !backlog.active && len(backlog.jobs) == 1 {
+		p.markReady(key)
+	}
+}
+
+// take waits for a job a worker can handle. It returns false once the pool
+// is closed and nothing is left to handle.
+func (p *Pool) take() (string, job, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.ready) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+
+	if len(p.ready) == 0 {
+		return "", job{}, false
+	}
+
+	key := p.ready[0]
+	p.ready = p.ready[1:]
+
+	backlog := p.keys[key]
+	j := backlog.jobs[0]
+	backlog.jobs[0] = job{}
+	backlog.jobs = backlog.jobs[1:]
+	backlog.active = true
+	p.handling++
+
+	return key, j, true
+}
+
+// release lets workers take the next job of a key.
+func (p *Pool) release(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.handling--
+	p.reactivate(key)
+}
+
+// retryLater hands a job back to the workers after a delay, keeping the
+// other jobs of its key waiting until it's done.
+func (p *Pool) retryLater(key string, j job, after time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.handling--
+
+	if p.closed {
+		// It's picked up from the store after a restart
+		p.reactivate(key)
+		return
+	}
+
+	p.retrying++
+
+	time.AfterFunc(after, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		p.retrying--
+		backlog := p.keys[key]
+		backlog.jobs = append([]job{j}, backlog.jobs...)
+		p.reactivate(key)
+	})
+}
+
+// reactivate marks a key as no longer active. It must be called with mu held.
+func (p *Pool) reactivate(key string) {
+	backlog := p.keys[key]
+	backlog.active = false
+
+	if len(backlog.jobs) == 0 {
+		delete(p.keys, key)
+		return
+	}
+
+	p.markReady(key)
+}
+
+// markReady hands a key to the workers. It must be called with mu held.
+func (p *Pool) markReady(key string) {
+	p.ready = append(p.ready, key)
+	p.cond.Signal()
+}
+
+// waiting is the number of events that have been dispatched but aren't
+// being handled or retried. It must be called with mu held.
+func (p *Pool) waiting() int {
+	var waiting int
+	for _, backlog := range p.keys {
+		waiting += len(backlog.jobs)
+	}
+
+	return waiting
+}
+
+// Depth is the number of events waiting to be handled.
+func (p *Pool) Depth() int {
+	queued := p.queue.Len()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return queued + p.waiting() + p.retrying
+}
+
+// ServeHTTP reports how many events are waiting.
+func (p *Pool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	queued := p.queue.Len()
+
+	p.mu.Lock()
+	waiting, handling, retrying := p.waiting(), p.handling, p.retrying
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Queued   int `json:"queued"`
+		Waiting  int `json:"waiting"`
+		Handling int `json:"handling"`
+		Retrying int `json:"retrying"`
+	}{queued, waiting, handling, retrying})
+}
@@ -0,0 +1,190 @@
+package githubwebhook
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	gh "github.com/google/go-github/v31/github"
+	"github.com/pkg/errors"
+)
+
+// pullRequest is the head of a pull request.
+type pullRequest struct {
+	branch string
+	sha    string
+	// fork is set if the head is in another repo
+	fork *forkRepo
+}
+
+// forkRepo is the repo a pull request from a fork comes from.
+type forkRepo struct {
+	owner    string
+	name     string
+	id       int64
+	private  bool
+	httpsURL string
+	sshURL   string
+}
+
+// provider is the code host of a repository. Comments are identified by the
+// pull request they're on and their ID.
+type provider interface {
+	// pullRequest looks up the head of a pull request
+	pullRequest(ctx context.Context, owner, name string, number int) (pullRequest, error)
+	// addDeployKey gives key read access to a repository, returning its ID
+	addDeployKey(ctx context.Context, owner, name string, key []byte) (int64, error)
+	// addForkDeployKey gives key read access to a fork, if we can access it
+	addForkDeployKey(ctx context.Context, fork *forkRepo, key []byte) (int64, error)
+	// approved checks whether someone with write permission approved sha
+	approved(ctx context.Context, owner, name string, number int, sha string) (bool, error)
+	// permission is none, read, write or admin
+	permission(ctx context.Context, owner, name, user string) (string, error)
+	// isTeamMember checks whether user is an active member of one of teams
+	isTeamMember(ctx context.Context, user string, teams []string) (bool, error)
+	react(ctx context.Context, owner, name string, number int, id int64, reaction string) error
+	// comment returns the ID of the new comment
+	comment(ctx context.Context, owner, name string, number int, body string) (int64, error)
+	editComment(ctx context.Context, owner, name string, number int, id int64, body string) error
+	// gitURL is what flux clones, empty to use the GitHub endpoints
+	gitURL(owner, name string) string
+}
+
+// githubProvider acts as an installation of our GitHub app.
+type githubProvider struct {
+	cli *gh.Client
+	// forRepo gives us the installation of other repos, like forks
+	forRepo func(ctx context.Context, owner, repo string) (*gh.Client, error)
+}
+
+func (p *githubProvider) pullRequest(ctx context.Context, owner, name string, number int) (pullRequest, error) {
+	pr, _, err := p.cli.PullRequests.Get(ctx, owner, name, number)
+	if err != nil {
+		return pullRequest{}, err
+	}
+	head := pr.GetHead()
+	if head.GetRepo() == nil {
+		return pullRequest{}, errors.New("the repository of the pull request was deleted")
+	}
+	found := pullRequest{branch: head.GetRef(), sha: head.GetSHA()}
+	if repo := head.GetRepo(); repo.GetID() != pr.GetBase().GetRepo().GetID() {
+		found.fork = &forkRepo{
+			owner:    repo.GetOwner().GetLogin(),
+			name:     repo.GetName(),
+			id:       repo.GetID(),
+			private:  repo.GetPrivate(),
+			httpsURL: repo.GetCloneURL(),
+			sshURL:   repo.GetSSHURL(),
+		}
+	}
+	return found, nil
+}
+
+func (p *githubProvider) addDeployKey(ctx context.Context, owner, name string, key []byte) (int64, error) {
+	pubKey := string(key)
+	ghKey := gh.Key{Title: &properator, Key: &pubKey, ReadOnly: &readOnlyKey}
+	created, resp, err := p.cli.Repositories.CreateKey(ctx, owner, name, &ghKey)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return 0, errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return created.GetID(), nil
+}
+
+// addForkDeployKey needs our app to be installed on the fork.
+func (p *githubProvider) addForkDeployKey(ctx context.Context, fork *forkRepo, key []byte) (int64, error) {
+	cli, err := p.forRepo(ctx, fork.owner, fork.name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't find an installation on %s/%s", fork.owner, fork.name)
+	}
+	return (&githubProvider{cli: cli}).addDeployKey(ctx, fork.owner, fork.name, key)
+}
+
+// approved only counts the latest review of each reviewer.
+func (p *githubProvider) approved(ctx context.Context, owner, name string, number int, sha string) (bool, error) {
+	latest := map[string]*gh.PullRequestReview{}
+	opts := &gh.ListOptions{PerPage: 100}
+	for {
+		reviews, resp, err := p.cli.PullRequests.ListReviews(ctx, owner, name, number, opts)
+		if err != nil {
+			return false, err
+		}
+		for _, review := range reviews {
+			// Comments don't dismiss earlier reviews
+			if review.GetState() != "COMMENTED" {
+				latest[review.GetUser().GetLogin()] = review
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	for user, review := range latest {
+		if review.GetState() != "APPROVED" || review.GetCommitID() != sha {
+			continue
+		}
+		level, err := p.permission(ctx, owner, name, user)
+		if err != nil {
+			return false, err
+		}
+		if permissionRanks[level] >= permissionRanks["write"] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (p *githubProvider) permission(ctx context.Context, owner, name, user string) (string, error) {
+	perm, _, err := p.cli.Repositories.GetPermissionLevel(ctx, owner, name, user)
+	if err != nil {
+		return "", err
+	}
+	return perm.GetPermission(), nil
+}
+
+func (p *githubProvider) isTeamMember(ctx context.Context, user string, teams []string) (bool, error) {
+	for _, team := range teams {
+		parts := strings.SplitN(team, "/", 2)
+
+		membership, resp, err := p.cli.Teams.GetTeamMembershipBySlug(ctx, parts[0], parts[1], user)
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				continue
+			}
+
+			return false, errors.Wrapf(err, "couldn't get membership of %s in %s", user, team)
+		}
+
+		if membership.GetState() == "active" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (p *githubProvider) react(ctx context.Context, owner, name string, _ int, id int64, reaction string) error {
+	_, _, err := p.cli.Reactions.CreateIssueCommentReaction(ctx, owner, name, id, reaction)
+	return err
+}
+
+func (p *githubProvider) comment(ctx context.Context, owner, name string, number int, body string) (int64, error) {
+	posted, _, err := p.cli.Issues.CreateComment(ctx, owner, name, number, &gh.IssueComment{Body: &body})
+	if err != nil {
+		return 0, err
+	}
+	return posted.GetID(), nil
+}
+
+func (p *githubProvider) editComment(ctx context.Context, owner, name string, _ int, id int64, body string) error {
+	_, _, err := p.cli.Issues.EditComment(ctx, owner, name, id, &gh.IssueComment{Body: &body})
+	return err
+}
+
+func (p *githubProvider) gitURL(owner, name string) string {
+	return ""
+}
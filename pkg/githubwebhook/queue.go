@@ -0,0 +1,389 @@
+package githubwebhook
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gh "github.com/google/go-github/v31/github"
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// +kubebuilder:rbac:groups=deploy.properator.io,resources=webhookevents,verbs=get;list;watch;create;update;patch;delete
+
+// handledEvents are the only event types worth keeping.
+var handledEvents = map[string]bool{
+	"issue_comment":             true,
+	"pull_request":              true,
+	"installation":              true,
+	"installation_repositories": true,
+	gitlab.NoteHook:             true,
+	gitlab.MergeRequestHook:     true,
+}
+
+// Event is a validated webhook delivery.
+type Event struct {
+	// ID identifies the event in an EventStore
+	ID         string
+	Type       string
+	DeliveryID string
+	ReceivedAt time.Time
+	Payload    []byte
+}
+
+// Parse gives us the go-github or gitlab type of the event.
+func (e Event) Parse() (interface{}, error) {
+	if e.Type == gitlab.NoteHook || e.Type == gitlab.MergeRequestHook {
+		return gitlab.ParseWebHook(e.Type, e.Payload)
+	}
+	return gh.ParseWebHook(e.Type, e.Payload)
+}
+
+// deliveryIDPattern is what delivery IDs have to look like, as they end up in
+// file and resource names. Both GitHub and GitLab send UUIDs.
+var deliveryIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]{0,63}[A-Za-z0-9]$`)
+
+// checkDeliveryID makes sure a delivery ID is safe to name things after.
+// Deliveries without an ID are fine.
+func checkDeliveryID(id string) error {
+	if id != "" && !deliveryIDPattern.MatchString(id) {
+		return errors.Errorf("invalid delivery ID %q", id)
+	}
+	return nil
+}
+
+// EventStore persists events until they've been handled and remembers
+// deliveries for a while afterwards.
+type EventStore interface {
+	// Put saves an event, setting its ID. It returns false if the delivery
+	// has been stored before.
+	Put(ctx context.Context, event *Event) (bool, error)
+	// Pending lists the events that haven't been handled, oldest first.
+	Pending(ctx context.Context) ([]Event, error)
+	// Done marks an event as handled.
+	Done(ctx context.Context, event Event) error
+	// DeadLetter keeps an event that couldn't be handled out of Pending.
+	DeadLetter(ctx context.Context, event Event, reason error) error
+	// Prune forgets about events handled that were received before a time.
+	Prune(ctx context.Context, before time.Time) error
+}
+
+const (
+	// handledLabel marks events that have been handled. They're only kept
+	// to recognize redeliveries.
+	handledLabel = "deploy.properator.io/handled"
+	// deadLetterLabel marks events that couldn't be handled. Removing it
+	// replays the event.
+	deadLetterLabel = "deploy.properator.io/dead-letter"
+	// errorAnnotation holds why the event couldn't be handled
+	errorAnnotation = "deploy.properator.io/error"
+)
+
+// ResourceStore keeps events as WebhookEvent resources.
+type ResourceStore struct {
+	k8s       client.Client
+	namespace string
+}
+
+// NewResourceStore creates an EventStore in a namespace.
+func NewResourceStore(k8s client.Client, namespace string) *ResourceStore {
+	return &ResourceStore{k8s, namespace}
+}
+
+// Put creates a WebhookEvent.
+func (s *ResourceStore) Put(ctx context.Context, event *Event) (bool, error) {
+	resource := deployv1alpha1.WebhookEvent{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "event-",
+			Namespace:    s.namespace,
+		},
+		Spec: deployv1alpha1.WebhookEventSpec{
+			Type:       event.Type,
+			DeliveryID: event.DeliveryID,
+			ReceivedAt: metav1.NewMicroTime(event.ReceivedAt),
+			Payload:    event.Payload,
+		},
+	}
+	if err := checkDeliveryID(event.DeliveryID); err != nil {
+		return false, err
+	}
+	if event.DeliveryID != "" {
+		resource.Name = "delivery-" + strings.ToLower(event.DeliveryID)
+	}
+	if err := s.k8s.Create(ctx, &resource); err != nil {
+		// Redeliveries are named after the same delivery ID
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "couldn't store event")
+	}
+	event.ID = resource.Name
+	return true, nil
+}
+
+func eventFromResource(resource *deployv1alpha1.WebhookEvent) Event {
+	return Event{
+		ID:         resource.Name,
+		Type:       resource.Spec.Type,
+		DeliveryID: resource.Spec.DeliveryID,
+		ReceivedAt: resource.Spec.ReceivedAt.Time,
+		Payload:    resource.Spec.Payload,
+	}
+}
+
+// Pending lists all WebhookEvents that haven't been handled or dead lettered.
+func (s *ResourceStore) Pending(ctx context.Context) ([]Event, error) {
+	pending, err := labels.Parse(fmt.Sprintf("!%s,!%s", handledLabel, deadLetterLabel))
+	if err != nil {
+		return nil, err
+	}
+	var resources deployv1alpha1.WebhookEventList
+	if err := s.k8s.List(
+		ctx, &resources, client.InNamespace(s.namespace), client.MatchingLabelsSelector{Selector: pending},
+	); err != nil {
+		return nil, errors.Wrap(err, "couldn't list stored events")
+	}
+	events := make([]Event, 0, len(resources.Items))
+	for i := range resources.Items {
+		events = append(events, eventFromResource(&resources.Items[i]))
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].ReceivedAt.Before(events[j].ReceivedAt)
+	})
+	return events, nil
+}
+
+// Done labels the WebhookEvent as handled and drops its payload.
+func (s *ResourceStore) Done(ctx context.Context, event Event) error {
+	var resource deployv1alpha1.WebhookEvent
+	if err := s.k8s.Get(ctx, types.NamespacedName{Name: event.ID, Namespace: s.namespace}, &resource); err != nil {
+		return errors.Wrap(client.IgnoreNotFound(err), "couldn't get stored event")
+	}
+	if resource.Labels == nil {
+		resource.Labels = map[string]string{}
+	}
+	resource.Labels[handledLabel] = "true"
+	delete(resource.Labels, deadLetterLabel)
+	resource.Spec.Payload = nil
+	return errors.Wrap(s.k8s.Update(ctx, &resource), "couldn't mark stored event as handled")
+}
+
+// DeadLetter labels the WebhookEvent.
+func (s *ResourceStore) DeadLetter(ctx context.Context, event Event, reason error) error {
+	var resource deployv1alpha1.WebhookEvent
+	if err := s.k8s.Get(ctx, types.NamespacedName{Name: event.ID, Namespace: s.namespace}, &resource); err != nil {
+		return errors.Wrap(err, "couldn't get stored event")
+	}
+	if resource.Labels == nil {
+		resource.Labels = map[string]string{}
+	}
+	if resource.Annotations == nil {
+		resource.Annotations = map[string]string{}
+	}
+	resource.Labels[deadLetterLabel] = "true"
+	resource.Annotations[errorAnnotation] = reason.Error()
+	return errors.Wrap(s.k8s.Update(ctx, &resource), "couldn't dead letter stored event")
+}
+
+// Prune deletes handled WebhookEvents received before a time.
+func (s *ResourceStore) Prune(ctx context.Context, before time.Time) error {
+	var resources deployv1alpha1.WebhookEventList
+	if err := s.k8s.List(
+		ctx, &resources, client.InNamespace(s.namespace), client.MatchingLabels{handledLabel: "true"},
+	); err != nil {
+		return errors.Wrap(err, "couldn't list handled events")
+	}
+	for i := range resources.Items {
+		resource := &resources.Items[i]
+		if !resource.Spec.ReceivedAt.Time.Before(before) {
+			continue
+		}
+		if err := s.k8s.Delete(ctx, resource); client.IgnoreNotFound(err) != nil {
+			return errors.Wrap(err, "couldn't delete handled event")
+		}
+	}
+	return nil
+}
+
+// Queue hands out stored events to workers.
+type Queue struct {
+	store EventStore
+	// retention is how long handled deliveries are remembered
+	retention time.Duration
+	events    chan Event
+	mu        sync.Mutex
+	closed    bool
+	// backlog holds events, oldest first, that didn't fit in events. They're
+	// handed out before any newer event so events for a PR stay in order.
+	backlog []Event
+	// queued holds the IDs of events that are waiting or being handled
+	queued map[string]bool
+	// finished holds the IDs of events the store has marked as handled since
+	// the last Resync, which may have listed them as pending before that
+	finished map[string]bool
+}
+
+// NewQueue creates a queue buffering up to size events in memory.
+// Deliveries are recognized as duplicates for the retention period.
+func NewQueue(store EventStore, size int, retention time.Duration) *Queue {
+	return &Queue{
+		store:     store,
+		retention: retention,
+		events:    make(chan Event, size),
+		queued:    map[string]bool{},
+		finished:  map[string]bool{},
+	}
+}
+
+// Events is where workers get events from.
+func (q *Queue) Events() <-chan Event {
+	return q.events
+}
+
+// Add stores and queues an event.
+// It returns false if the delivery has been seen before.
+func (q *Queue) Add(ctx context.Context, event Event) (bool, error) {
+	added, err := q.store.Put(ctx, &event)
+	if err != nil || !added {
+		return false, err
+	}
+	q.offer(event)
+	return true, nil
+}
+
+func (q *Queue) offer(event Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.queued[event.ID] || q.finished[event.ID] {
+		return
+	}
+	q.queued[event.ID] = true
+	q.backlog = append(q.backlog, event)
+	q.drain()
+}
+
+// drain moves as much of the backlog as fits into events.
+// It must be called with mu held.
+func (q *Queue) drain() {
+	for len(q.backlog) > 0 && !q.closed {
+		select {
+		case q.events <- q.backlog[0]:
+			q.backlog[0] = Event{}
+			q.backlog = q.backlog[1:]
+		default:
+			return
+		}
+	}
+}
+
+// Len is the number of events waiting to be handed out.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events) + len(q.backlog)
+}
+
+// Resync queues all stored events that aren't queued already.
+// It mustn't run concurrently with itself.
+func (q *Queue) Resync(ctx context.Context) error {
+	// Events finished from here on may still be in the pending list
+	q.mu.Lock()
+	q.finished = map[string]bool{}
+	q.mu.Unlock()
+
+	pending, err := q.store.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	for _, event := range pending {
+		q.offer(event)
+	}
+	// Room may have been made without anything being offered
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.drain()
+	return nil
+}
+
+// Prune forgets about deliveries older than the retention period.
+func (q *Queue) Prune(ctx context.Context) error {
+	return q.store.Prune(ctx, time.Now().Add(-q.retention))
+}
+
+// Run resyncs and prunes every interval until stop is closed. Anything else
+// that needs pruning is passed as prune.
+func (q *Queue) Run(
+	stop <-chan struct{}, interval time.Duration, onError func(error), prune ...func(context.Context) error,
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := q.Resync(context.Background()); err != nil {
+				onError(err)
+			}
+			if err := q.Prune(context.Background()); err != nil {
+				onError(err)
+			}
+			for _, p := range prune {
+				if err := p(context.Background()); err != nil {
+					onError(err)
+				}
+			}
+		}
+	}
+}
+
+// Done marks an event as handled in the store.
+func (q *Queue) Done(ctx context.Context, event Event) error {
+	err := q.store.Done(ctx, event)
+	// If the event is still stored, it's handled again after a resync
+	q.finish(event, err)
+	return err
+}
+
+// finish forgets about a queued event, remembering it was taken out of the
+// store unless err is set.
+func (q *Queue) finish(event Event, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.queued, event.ID)
+	if err == nil {
+		q.finished[event.ID] = true
+	}
+	q.drain()
+}
+
+// DeadLetter keeps an event that couldn't be handled in the store without
+// handing it out again.
+func (q *Queue) DeadLetter(ctx context.Context, event Event, reason error) error {
+	err := q.store.DeadLetter(ctx, event, reason)
+	q.finish(event, err)
+	return err
+}
+
+// Close stops handing out events.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		// The backlog stays stored and is picked up after a restart
+		q.backlog = nil
+		close(q.events)
+	}
+}
@@ -0,0 +1,288 @@
+package githubwebhook
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v31/github"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryStore struct {
+	events  []Event
+	handled map[string]time.Time
+}
+
+func (s *memoryStore) Put(ctx context.Context, event *Event) (bool, error) {
+	if _, ok := s.handled[event.DeliveryID]; ok {
+		return false, nil
+	}
+	for _, e := range s.events {
+		if event.DeliveryID != "" && e.DeliveryID == event.DeliveryID {
+			return false, nil
+		}
+	}
+	event.ID = fmt.Sprintf("event-%d", len(s.events)+len(s.handled))
+	s.events = append(s.events, *event)
+	return true, nil
+}
+
+func (s *memoryStore) Pending(ctx context.Context) ([]Event, error) {
+	return s.events, nil
+}
+
+func (s *memoryStore) Done(ctx context.Context, event Event) error {
+	for i, e := range s.events {
+		if e.ID == event.ID {
+			s.events = append(s.events[:i], s.events[i+1:]...)
+			if s.handled == nil {
+				s.handled = map[string]time.Time{}
+			}
+			s.handled[e.DeliveryID] = e.ReceivedAt
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) DeadLetter(ctx context.Context, event Event, reason error) error {
+	return s.Done(ctx, event)
+}
+
+func (s *memoryStore) Prune(ctx context.Context, before time.Time) error {
+	for id, receivedAt := range s.handled {
+		if receivedAt.Before(before) {
+			delete(s.handled, id)
+		}
+	}
+	return nil
+}
+
+func added(t *testing.T) func(bool, error) bool {
+	return func(ok bool, err error) bool {
+		assert.NoError(t, err)
+		return ok
+	}
+}
+
+func TestQueue(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{}
+	queue := NewQueue(store, 1, time.Hour)
+	isAdded := added(t)
+
+	assert.True(t, isAdded(queue.Add(ctx, Event{Type: "pull_request", DeliveryID: "1"})))
+	assert.True(t, isAdded(queue.Add(ctx, Event{Type: "issue_comment", DeliveryID: "2"})))
+	assert.Len(t, store.events, 2, "events are stored even without room in the queue")
+
+	first := <-queue.Events()
+	assert.Equal(t, "pull_request", first.Type)
+	assert.NoError(t, queue.Resync(ctx))
+	assert.Len(t, queue.Events(), 1, "the stored event now has room")
+
+	assert.NoError(t, queue.Done(ctx, first))
+	assert.NoError(t, queue.Resync(ctx))
+	assert.Len(t, queue.Events(), 1, "queued events aren't queued again")
+	second := <-queue.Events()
+	assert.Equal(t, "issue_comment", second.Type)
+	assert.NoError(t, queue.Done(ctx, second))
+	assert.Empty(t, store.events)
+
+	queue.Close()
+	_, ok := <-queue.Events()
+	assert.False(t, ok)
+}
+
+func TestQueueOrder(t *testing.T) {
+	ctx := context.Background()
+	queue := NewQueue(&memoryStore{}, 1, time.Hour)
+	isAdded := added(t)
+
+	for _, id := range []string{"1", "2"} {
+		assert.True(t, isAdded(queue.Add(ctx, Event{Type: "pull_request", DeliveryID: id})))
+	}
+	assert.Equal(t, 2, queue.Len())
+
+	first := <-queue.Events()
+	assert.Equal(t, "1", first.DeliveryID)
+	assert.True(t, isAdded(queue.Add(ctx, Event{Type: "pull_request", DeliveryID: "3"})))
+	assert.Equal(t, "2", (<-queue.Events()).DeliveryID, "waiting events go before newer ones")
+
+	assert.NoError(t, queue.Done(ctx, first))
+	assert.Equal(t, "3", (<-queue.Events()).DeliveryID)
+}
+
+// racingStore finishes an event while it's being listed as pending.
+type racingStore struct {
+	*memoryStore
+	queue *Queue
+}
+
+func (s *racingStore) Pending(ctx context.Context) ([]Event, error) {
+	pending := append([]Event(nil), s.memoryStore.events...)
+	for _, event := range pending {
+		if err := s.queue.Done(ctx, event); err != nil {
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+func TestQueueResyncFinished(t *testing.T) {
+	ctx := context.Background()
+	store := &racingStore{memoryStore: &memoryStore{}}
+	queue := NewQueue(store, 10, time.Hour)
+	store.queue = queue
+
+	assert.True(t, added(t)(queue.Add(ctx, Event{Type: "issue_comment", DeliveryID: "1"})))
+	<-queue.Events()
+
+	assert.NoError(t, queue.Resync(ctx))
+	assert.Empty(t, queue.Events(), "events finished during a resync aren't queued again")
+}
+
+func TestQueueRedelivery(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{}
+	queue := NewQueue(store, 10, time.Hour)
+	isAdded := added(t)
+
+	event := Event{Type: "issue_comment", DeliveryID: "1", ReceivedAt: time.Now()}
+	assert.True(t, isAdded(queue.Add(ctx, event)))
+	assert.False(t, isAdded(queue.Add(ctx, event)), "pending deliveries aren't added again")
+
+	assert.NoError(t, queue.Done(ctx, <-queue.Events()))
+	assert.False(t, isAdded(queue.Add(ctx, event)), "handled deliveries aren't added again")
+
+	assert.NoError(t, queue.Prune(ctx))
+	assert.False(t, isAdded(queue.Add(ctx, event)), "deliveries are remembered during retention")
+
+	queue.retention = 0
+	assert.NoError(t, queue.Prune(ctx))
+	assert.True(t, isAdded(queue.Add(ctx, event)))
+}
+
+func TestEventKey(t *testing.T) {
+	num := 23
+	id := int64(12345)
+	comment := github.IssueCommentEvent{
+		Issue: &github.Issue{Number: &num},
+		Repo:  &github.Repository{ID: &id},
+	}
+	pr := github.PullRequestEvent{
+		PullRequest: &github.PullRequest{Number: &num},
+		Repo:        &github.Repository{ID: &id},
+	}
+	assert.Equal(t, eventKey(&comment), eventKey(&pr))
+
+	installation := github.InstallationEvent{
+		Installation: &github.Installation{ID: &id},
+	}
+	assert.Equal(t, "installation-12345", eventKey(&installation))
+}
+
+func TestPool(t *testing.T) {
+	pool := NewPool(nil, NewQueue(&memoryStore{}, 1, time.Hour), 2)
+	take := func() (string, string) {
+		key, j, ok := pool.take()
+		assert.True(t, ok)
+		return key, j.event.ID
+	}
+
+	pool.dispatch("pr", job{event: Event{ID: "1"}})
+	pool.dispatch("pr", job{event: Event{ID: "2"}})
+	pool.dispatch("other", job{event: Event{ID: "3"}})
+
+	key, id := take()
+	assert.Equal(t, "pr", key)
+	assert.Equal(t, "1", id)
+	key, id = take()
+	assert.Equal(t, "other", key, "the PR's next event waits for the first")
+	assert.Equal(t, "3", id)
+	pool.release("other")
+
+	retried := false
+	pool.retryLater("pr", job{Event{ID: "1"}, func() error {
+		retried = true
+		return nil
+	}}, 10*time.Millisecond)
+	assert.Equal(t, 2, pool.Depth(), "the retry and the PR's next event are waiting")
+
+	key, retry, ok := pool.take()
+	assert.True(t, ok)
+	assert.Equal(t, "pr", key)
+	assert.Equal(t, "1", retry.event.ID, "retries go before newer events")
+	assert.NoError(t, retry.retry())
+	assert.True(t, retried)
+	pool.release("pr")
+
+	_, id = take()
+	assert.Equal(t, "2", id)
+	pool.release("pr")
+
+	pool.mu.Lock()
+	pool.closed = true
+	pool.mu.Unlock()
+	_, _, ok = pool.take()
+	assert.False(t, ok)
+	assert.Empty(t, pool.keys)
+}
+
+func TestCheckDeliveryID(t *testing.T) {
+	assert.NoError(t, checkDeliveryID(""))
+	assert.NoError(t, checkDeliveryID("72d3162e-cc78-11e3-81ab-4c9367dc0958"))
+	assert.Error(t, checkDeliveryID("../escape"))
+	assert.Error(t, checkDeliveryID("a/b"))
+	assert.Error(t, checkDeliveryID("a.b"))
+	assert.Error(t, checkDeliveryID("trailing-"))
+	assert.Error(t, checkDeliveryID(strings.Repeat("a", 65)))
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	archive, err := NewArchive(dir, 2)
+	assert.NoError(t, err)
+
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, archive.Save(Event{
+			Type:       "pull_request",
+			DeliveryID: fmt.Sprintf("delivery-%d", i),
+			ReceivedAt: start.Add(time.Duration(i) * time.Second),
+			Payload:    []byte(`{"action": "opened"}`),
+		}))
+	}
+
+	assert.Error(t, archive.Save(Event{
+		Type:       "pull_request",
+		DeliveryID: "../../escape",
+		ReceivedAt: start.Add(time.Minute),
+	}))
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2, "the oldest delivery is removed")
+
+	event, err := LoadEvent(filepath.Join(dir, files[0].Name()), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "delivery-1", event.DeliveryID)
+	assert.Equal(t, "pull_request", event.Type)
+	assert.JSONEq(t, `{"action": "opened"}`, string(event.Payload))
+
+	raw := filepath.Join(dir, "raw")
+	assert.NoError(t, ioutil.WriteFile(raw, []byte(`{"action": "closed"}`), 0644))
+	_, err = LoadEvent(raw, "")
+	assert.Error(t, err, "raw payloads need a type")
+	event, err = LoadEvent(raw, "pull_request")
+	assert.NoError(t, err)
+	assert.Equal(t, "pull_request", event.Type)
+}
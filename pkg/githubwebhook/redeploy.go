@@ -0,0 +1,81 @@
+package githubwebhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type redeploy struct {
+	owner string
+	name  string
+	pr    prPointer
+}
+
+func (rd *redeploy) Act(webhook *WebhookHandler) error {
+	ctx := context.Background()
+	pr, err := webhook.provider.pullRequest(ctx, rd.owner, rd.name, rd.pr.number)
+	if err != nil {
+		return err
+	}
+	if pr.fork != nil {
+		if err := webhook.checkFork(ctx, rd.owner, rd.name, rd.pr.number, pr.sha); err != nil {
+			return err
+		}
+	}
+	ns, err := webhook.environment(ctx, rd.pr)
+	if err != nil {
+		return err
+	}
+	if ns == nil {
+		return errors.New("there's no environment to redeploy, deploy it first")
+	}
+	nn := types.NamespacedName{Name: releaseName, Namespace: ns.Name}
+
+	var refRelease deployv1alpha1.RefRelease
+	if err := webhook.k8s.Get(ctx, nn, &refRelease); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		return errors.New("there's no environment to redeploy, deploy it first")
+	}
+	refRelease.Spec.Ref.Sha = pr.sha
+	refRelease.Spec.Ref.Branch = pr.branch
+	refRelease.Spec.Ref.Pinned = webhook.pinned(pr.fork != nil)
+	if refRelease.Annotations == nil {
+		refRelease.Annotations = map[string]string{}
+	}
+	// The flux pod template gets this annotation, forcing a restart
+	refRelease.Annotations[deployv1alpha1.RestartedAtAnnotation] = time.Now().Format(time.RFC3339)
+	if err := webhook.k8s.Update(ctx, &refRelease); err != nil {
+		return errors.Wrap(err, "couldn't update RefRelease")
+	}
+
+	var gd deployv1alpha1.GithubDeployment
+	if err := webhook.k8s.Get(ctx, nn, &gd); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		return nil
+	}
+	// Clear the ID and reset the recorded status so the controller creates a
+	// new deployment for the latest commit
+	gd.Spec.Ref = pr.branch
+	gd.Spec.ID = 0
+	gd.Spec.Sha = pr.sha
+	gd.Status.DeploymentStatus = deployv1alpha1.DeploymentStatus{}
+	if err := webhook.k8s.Update(ctx, &gd); err != nil {
+		return errors.Wrap(err, "couldn't reset GithubDeployment")
+	}
+
+	return nil
+}
+
+func (rd *redeploy) Describe() string {
+	return fmt.Sprintf("Redeploying PR %d from %d", rd.pr.number, rd.pr.id)
+}
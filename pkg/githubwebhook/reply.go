@@ -0,0 +1,151 @@
+package githubwebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	gh "github.com/google/go-github/v31/github"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"github.com/pkg/errors"
+)
+
+const (
+	receivedReaction = "eyes"
+	rejectedReaction = "confused"
+)
+
+// reply is a comment we've posted in response to a command.
+type reply struct {
+	owner string
+	repo  string
+	pr    prPointer
+	id    int64
+}
+
+// trigger is a comment on a PR with commands for us.
+type trigger struct {
+	owner string
+	repo  string
+	pr    prPointer
+	id    int64
+	user  string
+}
+
+// triggerOf gives us the comment that caused an event, if any. Only new
+// comments count, so editing or deleting a command doesn't run it again.
+func triggerOf(event interface{}) (trigger, bool) {
+	switch event := event.(type) {
+	case *gh.IssueCommentEvent:
+		if event.GetAction() != "created" || !event.GetIssue().IsPullRequest() {
+			return trigger{}, false
+		}
+		return trigger{
+			owner: event.GetRepo().GetOwner().GetLogin(),
+			repo:  event.GetRepo().GetName(),
+			pr:    prPointer{id: event.GetRepo().GetID(), number: event.GetIssue().GetNumber()},
+			id:    event.GetComment().GetID(),
+			user:  event.GetComment().GetUser().GetLogin(),
+		}, true
+	case *gitlab.NoteEvent:
+		return noteTrigger(event)
+	default:
+		return trigger{}, false
+	}
+}
+
+// acknowledge reacts to the triggering comment and posts a reply
+// that is later edited to hold the outcome.
+func (webhook *WebhookHandler) acknowledge(ctx context.Context, t trigger, desc string) (*reply, error) {
+	if err := webhook.provider.react(ctx, t.owner, t.repo, t.pr.number, t.id, receivedReaction); err != nil {
+		return nil, errors.Wrap(err, "couldn't react to comment")
+	}
+
+	body := fmt.Sprintf(":hourglass: %s", desc)
+	id, err := webhook.provider.comment(ctx, t.owner, t.repo, t.pr.number, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't reply to comment")
+	}
+
+	return &reply{
+		owner: t.owner,
+		repo:  t.repo,
+		pr:    t.pr,
+		id:    id,
+	}, nil
+}
+
+// notice reacts to a comment we don't act on because we just did the same.
+func (webhook *WebhookHandler) notice(ctx context.Context, t trigger) error {
+	err := webhook.provider.react(ctx, t.owner, t.repo, t.pr.number, t.id, receivedReaction)
+	return errors.Wrap(err, "couldn't react to comment")
+}
+
+// finish edits our reply with the outcome of an action.
+func (webhook *WebhookHandler) finish(ctx context.Context, r *reply, a action, actErr error) error {
+	var details string
+	if d, ok := a.(detailed); ok {
+		details = d.Details()
+	}
+
+	// Dropped environments may still be terminating
+	var namespace string
+	if ns, err := webhook.environment(ctx, r.pr); err == nil && ns != nil {
+		namespace = ns.Name
+	}
+
+	body := outcome(a.Describe(), details, namespace, actErr)
+	err := webhook.provider.editComment(ctx, r.owner, r.repo, r.pr.number, r.id, body)
+
+	return errors.Wrap(err, "couldn't edit reply with outcome")
+}
+
+// reject tells the commenter we won't act on their comment.
+func (webhook *WebhookHandler) reject(ctx context.Context, t trigger, reason error) error {
+	if err := webhook.provider.react(ctx, t.owner, t.repo, t.pr.number, t.id, rejectedReaction); err != nil {
+		return errors.Wrap(err, "couldn't react to comment")
+	}
+
+	body := fmt.Sprintf(":warning: Sorry, I couldn't do that:\n\n%s", codeBlock(reason.Error()))
+
+	var permErr *permissionError
+	if errors.As(reason, &permErr) {
+		body = fmt.Sprintf(
+			":lock: Sorry @%s, you're not allowed to use `%s` here, %s.", permErr.user, permErr.verb, permErr.reason,
+		)
+	}
+	_, err := webhook.provider.comment(ctx, t.owner, t.repo, t.pr.number, body)
+
+	return errors.Wrap(err, "couldn't reply to comment")
+}
+
+func codeBlock(text string) string {
+	return fmt.Sprintf("```\n%s\n```", strings.TrimSpace(text))
+}
+
+// outcome formats the result of acting on a PR whose environment is in
+// namespace, if it has one.
+func outcome(desc, details, namespace string, err error) string {
+	var b strings.Builder
+	if err != nil {
+		fmt.Fprintf(&b, ":x: %s failed\n\n", desc)
+	} else {
+		fmt.Fprintf(&b, ":white_check_mark: %s\n\n", desc)
+	}
+
+	if namespace != "" {
+		b.WriteString("| Namespace | RefRelease |\n")
+		b.WriteString("| --- | --- |\n")
+		fmt.Fprintf(&b, "| `%s` | `%s` |\n", namespace, releaseName)
+	}
+
+	if details != "" {
+		fmt.Fprintf(&b, "\n%s\n", details)
+	}
+
+	if err != nil {
+		fmt.Fprintf(&b, "\n%s\n", codeBlock(err.Error()))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,132 @@
+package githubwebhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/utils"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;create;update;delete
+
+const (
+	closedLabel = "deploy.properator.io/closed-pr"
+	// closedAtAnnotation is when the PR of a record was last closed
+	closedAtAnnotation = "deploy.properator.io/closed-at"
+)
+
+// recordName is where we remember the environment of a closed PR
+// so it can be restored when the PR is reopened.
+func (pr prPointer) recordName() string {
+	return fmt.Sprintf("properator-closed-%s%v-%v", pr.prefix(), pr.id, pr.number)
+}
+
+func recordKey(pr prPointer) (types.NamespacedName, error) {
+	currentNs, err := utils.GetCurrentNamespace()
+	if err != nil {
+		return types.NamespacedName{}, err
+	}
+	return types.NamespacedName{Name: pr.recordName(), Namespace: currentNs}, nil
+}
+
+// remember records the environment of a PR.
+func remember(ctx context.Context, webhook *WebhookHandler, pr prPointer, spec deployv1alpha1.RefReleaseSpec) error {
+	nn, err := recordKey(pr)
+	if err != nil {
+		return err
+	}
+	record := v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      nn.Name,
+			Namespace: nn.Namespace,
+			Labels:    map[string]string{closedLabel: "true"},
+			Annotations: map[string]string{
+				closedAtAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+		Data: map[string]string{
+			"owner": spec.Repo.Owner,
+			"name":  spec.Repo.Name,
+			"path":  spec.Path,
+		},
+	}
+	return errors.Wrap(utils.CreateOrReplace(ctx, webhook.k8s, webhook.k8s, &record), "couldn't remember environment")
+}
+
+// pruneRecords forgets the environments of PRs closed before a time.
+func pruneRecords(ctx context.Context, k8s client.Client, before time.Time) error {
+	currentNs, err := utils.GetCurrentNamespace()
+	if err != nil {
+		return err
+	}
+	var records v1.ConfigMapList
+	if err := k8s.List(
+		ctx, &records, client.InNamespace(currentNs), client.MatchingLabels{closedLabel: "true"},
+	); err != nil {
+		return errors.Wrap(err, "couldn't list closed PRs")
+	}
+	for i := range records.Items {
+		record := &records.Items[i]
+		closedAt, err := time.Parse(time.RFC3339, record.Annotations[closedAtAnnotation])
+		if err != nil {
+			// Records from before we annotated them
+			closedAt = record.CreationTimestamp.Time
+		}
+		if !closedAt.Before(before) {
+			continue
+		}
+		if err := k8s.Delete(ctx, record); client.IgnoreNotFound(err) != nil {
+			return errors.Wrapf(err, "couldn't delete %s", record.Name)
+		}
+	}
+	return nil
+}
+
+// PruneRecords forgets the environments of PRs closed longer than
+// Config.ClosedRetention ago.
+func (webhook *WebhookWorker) PruneRecords(ctx context.Context) error {
+	if webhook.config.ClosedRetention == 0 {
+		return nil
+	}
+	return pruneRecords(ctx, webhook.k8s, time.Now().Add(-webhook.config.ClosedRetention))
+}
+
+// restore recreates the environment of a reopened PR, if it had one when it
+// was closed.
+type restore struct {
+	pr prPointer
+}
+
+func (r *restore) Act(webhook *WebhookHandler) error {
+	ctx := context.Background()
+	nn, err := recordKey(r.pr)
+	if err != nil {
+		return err
+	}
+	var record v1.ConfigMap
+	if err := webhook.k8s.Get(ctx, nn, &record); err != nil {
+		// Nothing to restore
+		return client.IgnoreNotFound(err)
+	}
+	create := create{
+		owner: record.Data["owner"],
+		name:  record.Data["name"],
+		path:  record.Data["path"],
+		pr:    r.pr,
+	}
+	if err := create.Act(webhook); err != nil {
+		return err
+	}
+	return client.IgnoreNotFound(webhook.k8s.Delete(ctx, &record))
+}
+
+func (r *restore) Describe() string {
+	return fmt.Sprintf("Restoring PR %d from %d", r.pr.number, r.pr.id)
+}
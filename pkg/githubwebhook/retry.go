@@ -0,0 +1,155 @@
+package githubwebhook
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	gh "github.com/google/go-github/v31/github"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// actionBackoff determines how often and how long we retry failed actions.
+var actionBackoff = wait.Backoff{
+	Duration: 2 * time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    5,
+	Cap:      time.Minute,
+}
+
+// maxRetryAfter is the longest we'll wait for GitHub to let us retry.
+const maxRetryAfter = 5 * time.Minute
+
+// isTransient tells us whether retrying an action might help.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var (
+		rateLimit  *gh.RateLimitError
+		abuseLimit *gh.AbuseRateLimitError
+		ghErr      *gh.ErrorResponse
+		glErr      *gitlab.Error
+		status     apierrors.APIStatus
+		netErr     net.Error
+	)
+
+	switch {
+	case errors.As(err, &rateLimit), errors.As(err, &abuseLimit):
+		return true
+	case errors.As(err, &ghErr):
+		return ghErr.Response != nil && ghErr.Response.StatusCode >= http.StatusInternalServerError
+	case errors.As(err, &glErr):
+		return glErr.StatusCode >= http.StatusInternalServerError || glErr.StatusCode == http.StatusTooManyRequests
+	case errors.As(err, &status):
+		statusErr := status.(error)
+		return apierrors.IsConflict(statusErr) ||
+			apierrors.IsServerTimeout(statusErr) ||
+			apierrors.IsTimeout(statusErr) ||
+			apierrors.IsTooManyRequests(statusErr) ||
+			apierrors.IsServiceUnavailable(statusErr) ||
+			apierrors.IsInternalError(statusErr)
+	case errors.As(err, &netErr):
+		return true
+	default:
+		return false
+	}
+}
+
+// RetryAfter tells us how long GitHub or GitLab wants us to wait after err,
+// if at all.
+func RetryAfter(err error) time.Duration {
+	var (
+		rateLimit  *gh.RateLimitError
+		abuseLimit *gh.AbuseRateLimitError
+		glErr      *gitlab.Error
+	)
+
+	switch {
+	case errors.As(err, &rateLimit):
+		return time.Until(rateLimit.Rate.Reset.Time)
+	case errors.As(err, &abuseLimit) && abuseLimit.RetryAfter != nil:
+		return *abuseLimit.RetryAfter
+	case errors.As(err, &glErr):
+		return glErr.RetryAfter
+	default:
+		return 0
+	}
+}
+
+// retryLater is returned instead of a transient error when an action should
+// be tried again after a delay. Workers don't wait for it, the Pool hands
+// retry to a worker once the delay is over.
+type retryLater struct {
+	err   error
+	after time.Duration
+	retry func() error
+}
+
+func (r *retryLater) Error() string {
+	return r.err.Error()
+}
+
+// Unwrap gives us the error that's being retried.
+func (r *retryLater) Unwrap() error {
+	return r.err
+}
+
+// act runs an action, retrying it as long as it fails with transient errors,
+// and passes the outcome to done. Retries are returned as retryLater.
+// If the action still fails after retrying, the error is transient.
+func (webhook *WebhookWorker) act(handler *WebhookHandler, a action, done func(error) error) error {
+	name := actionName(a)
+	start := time.Now()
+	backoff := actionBackoff
+
+	var try func() error
+	try = func() error {
+		err := a.Act(handler)
+		if delay, ok := retryDelay(err, &backoff); ok {
+			actionRetriesTotal.WithLabelValues(name).Inc()
+			webhook.log.Info("Retrying action", "action", a.Describe(), "error", err.Error(), "after", delay)
+			return &retryLater{err, delay, try}
+		}
+
+		actionDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			actionErrorsTotal.WithLabelValues(name, strconv.FormatBool(isTransient(err))).Inc()
+		}
+		return done(err)
+	}
+	return try()
+}
+
+// retryDelay tells us how long to wait before retrying after err, if it's
+// worth retrying at all.
+func retryDelay(err error, backoff *wait.Backoff) (time.Duration, bool) {
+	if !isTransient(err) || backoff.Steps < 1 {
+		return 0, false
+	}
+
+	delay := backoff.Step()
+	if after := RetryAfter(err); after > maxRetryAfter {
+		return 0, false
+	} else if after > delay {
+		delay = after
+	}
+	return delay, true
+}
+
+// retryInPlace waits for and runs the retries err asks for. It's for handling
+// events outside of a Pool.
+func retryInPlace(err error) error {
+	var later *retryLater
+	for errors.As(err, &later) {
+		time.Sleep(later.after)
+		err = later.retry()
+	}
+	return err
+}
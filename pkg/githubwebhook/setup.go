@@ -6,17 +6,20 @@ import (
 	"net/http"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bradleyfalzon/ghinstallation"
 	gh "github.com/google/go-github/v31/github"
 	"github.com/pkg/errors"
 )
 
-const secretsPath = "/etc/secrets"
+// SecretsDir is where the github-secrets volume is mounted.
+var SecretsDir = "/etc/secrets"
 
 // GetSecret gets a secret from the mounted volume.
 func GetSecret(k string) ([]byte, error) {
-	contents, err := ioutil.ReadFile(filepath.Join(secretsPath, k))
+	contents, err := ioutil.ReadFile(filepath.Join(SecretsDir, k))
 	return contents, errors.Wrapf(err, "unable to get %s as mounted secret", k)
 }
 
@@ -29,11 +32,24 @@ type GhCliSetup struct {
 	Username      string
 	CliForInstall ClientForInstallation
 	CliForApp     *gh.Client
+	Endpoints     Endpoints
+	// Clients backs CliForInstall
+	Clients *ClientCache
+}
+
+// githubTransport is the transport under every GitHub client, shared by
+// clients with the same name.
+func githubTransport(limits *rateLimits, client string) http.RoundTripper {
+	return &rateLimitTransport{
+		next:  &instrumentedTransport{http.DefaultTransport, client},
+		limit: limits.get(client),
+	}
 }
 
 // SetupGhCli abstracts away the github app aspect and gives us a username
-// to pay attention to and a way to get a GH client.
-func SetupGhCli(ctx context.Context) (GhCliSetup, error) {
+// to pay attention to and a way to get a GH client. Clients and the
+// installations of repos are cached for clientTTL.
+func SetupGhCli(ctx context.Context, clientTTL time.Duration) (GhCliSetup, error) {
 	rawAppID, err := GetSecret("APP_ID")
 	if err != nil {
 		return GhCliSetup{}, err
@@ -49,26 +65,54 @@ func SetupGhCli(ctx context.Context) (GhCliSetup, error) {
 		return GhCliSetup{}, err
 	}
 
-	transport, err := ghinstallation.NewAppsTransport(http.DefaultTransport, appID, privateKey)
+	endpoints, err := GetEndpoints()
+	if err != nil {
+		return GhCliSetup{}, err
+	}
+
+	limits := newRateLimits()
+
+	transport, err := ghinstallation.NewAppsTransport(githubTransport(limits, "app"), appID, privateKey)
 	if err != nil {
 		return GhCliSetup{}, errors.Wrapf(err, "couldn't authenticate as app")
 	}
 
-	ghcli := gh.NewClient(&http.Client{Transport: transport})
+	if endpoints.IsEnterprise() {
+		transport.BaseURL = strings.TrimSuffix(endpoints.APIURL, "/")
+	}
+
+	ghcli, err := endpoints.NewClient(&http.Client{Transport: transport})
+	if err != nil {
+		return GhCliSetup{}, errors.Wrap(err, "couldn't create client for app")
+	}
 
 	app, _, err := ghcli.Apps.Get(ctx, "")
 	if err != nil {
 		return GhCliSetup{}, errors.Wrapf(err, "problem getting username from github")
 	}
 
+	var clients *ClientCache
 	var makeGhCli ClientForInstallation = func(installationID int64) (*gh.Client, error) {
-		transport, err := ghinstallation.New(http.DefaultTransport, appID, installationID, privateKey)
+		// Token requests go through here too, so installations that were
+		// removed are forgotten as well
+		next := clients.forgetOnFailure(installationID, githubTransport(limits, strconv.FormatInt(installationID, 10)))
+		transport, err := ghinstallation.New(next, appID, installationID, privateKey)
 		if err != nil {
 			return nil, errors.Wrapf(err, "couldn't create client for installation")
 		}
 
-		return gh.NewClient(&http.Client{Transport: transport}), nil
+		if endpoints.IsEnterprise() {
+			transport.BaseURL = strings.TrimSuffix(endpoints.APIURL, "/")
+		}
+
+		return endpoints.NewClient(&http.Client{Transport: transport})
+	}
+
+	findInstallation := func(ctx context.Context, owner, repo string) (int64, error) {
+		inst, _, err := ghcli.Apps.FindRepositoryInstallation(ctx, owner, repo)
+		return inst.GetID(), err
 	}
+	clients = newClientCache(clientTTL, makeGhCli, findInstallation)
 
-	return GhCliSetup{app.GetSlug(), makeGhCli, ghcli}, nil
+	return GhCliSetup{app.GetSlug(), clients.ForInstallation, ghcli, endpoints, clients}, nil
 }
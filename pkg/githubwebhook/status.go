@@ -0,0 +1,109 @@
+package githubwebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type status struct {
+	pr      prPointer
+	details string
+}
+
+type statusRow struct {
+	key   string
+	value string
+}
+
+func code(s string) string {
+	if s == "" {
+		return ""
+	}
+	return fmt.Sprintf("`%s`", s)
+}
+
+func statusTable(rows []statusRow) string {
+	var b strings.Builder
+	b.WriteString("| | |\n| --- | --- |\n")
+	for _, row := range rows {
+		fmt.Fprintf(&b, "| %s | %s |\n", row.key, row.value)
+	}
+	return b.String()
+}
+
+func (s *status) Act(webhook *WebhookHandler) error {
+	ctx := context.Background()
+	ns, err := webhook.environment(ctx, s.pr)
+	if err != nil {
+		return err
+	}
+	if ns == nil {
+		s.details = "There's no environment for this PR."
+		return nil
+	}
+
+	nn := types.NamespacedName{Name: releaseName, Namespace: ns.Name}
+	var rows []statusRow
+
+	var ref deployv1alpha1.RefRelease
+	if err := webhook.k8s.Get(ctx, nn, &ref); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		rows = append(rows, statusRow{"RefRelease", "missing"})
+	} else {
+		rows = append(rows,
+			statusRow{"Branch", code(ref.Spec.Ref.Branch)},
+			statusRow{"Sha", code(ref.Spec.Ref.Sha)},
+			statusRow{"Path", code(ref.Spec.Path)},
+		)
+		if expires, ok := ref.ExpiresAt(); ok {
+			rows = append(rows, statusRow{"Expires", expires.UTC().Format(time.RFC1123)})
+		}
+	}
+
+	var gd deployv1alpha1.GithubDeployment
+	if err := webhook.k8s.Get(ctx, nn, &gd); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		rows = append(rows, statusRow{"Deployment", "missing"})
+	} else {
+		rows = append(rows,
+			statusRow{"Deployment", fmt.Sprintf("%d at %s", gd.Spec.ID, code(gd.Spec.Sha))},
+			statusRow{"State", gd.Status.State},
+			statusRow{"URL", gd.Status.URL},
+		)
+	}
+
+	var flux appsv1.Deployment
+	if err := webhook.k8s.Get(ctx, nn, &flux); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		rows = append(rows, statusRow{"Flux", "not running"})
+	} else {
+		rows = append(rows, statusRow{
+			"Flux", fmt.Sprintf("%d/%d pods ready", flux.Status.ReadyReplicas, flux.Status.Replicas),
+		})
+	}
+
+	s.details = statusTable(rows)
+
+	return nil
+}
+
+func (s *status) Describe() string {
+	return fmt.Sprintf("Getting status of PR %d from %d", s.pr.number, s.pr.id)
+}
+
+func (s *status) Details() string {
+	return s.details
+}
@@ -0,0 +1,46 @@
+package githubwebhook
+
+import (
+	"context"
+
+	gh "github.com/google/go-github/v31/github"
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/pkg/errors"
+)
+
+// ParseGitAuth checks how flux should authenticate with GitHub repos.
+func ParseGitAuth(raw string) (string, error) {
+	switch raw {
+	case deployv1alpha1.SSHAuth, deployv1alpha1.TokenAuth:
+		return raw, nil
+	default:
+		return "", errors.Errorf("expected %s or %s, got %q", deployv1alpha1.SSHAuth, deployv1alpha1.TokenAuth, raw)
+	}
+}
+
+// RepoToken creates an installation token that can only read the contents
+// of a repo, so flux can clone it over HTTPS.
+func (s GhCliSetup) RepoToken(ctx context.Context, owner, name string) (*gh.InstallationToken, error) {
+	installationID, err := s.Clients.InstallationForRepo(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := s.Clients.ForInstallation(installationID)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, _, err := cli.Repositories.Get(ctx, owner, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't get %s/%s", owner, name)
+	}
+
+	contents := "read"
+	token, _, err := s.CliForApp.Apps.CreateInstallationToken(ctx, installationID, &gh.InstallationTokenOptions{
+		RepositoryIDs: []int64{repo.GetID()},
+		Permissions:   &gh.InstallationPermissions{Contents: &contents},
+	})
+
+	return token, errors.Wrap(err, "couldn't create installation token")
+}
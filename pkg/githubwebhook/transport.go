@@ -0,0 +1,172 @@
+package githubwebhook
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRateLimitWait is the longest a request waits for a rate limit.
+	// Requests needing to wait longer are sent anyway and go-github reports
+	// the rate limit error, letting callers decide when to come back.
+	maxRateLimitWait = 30 * time.Second
+	// serverErrorRetries is how often idempotent requests are retried after
+	// a 5xx response.
+	serverErrorRetries = 3
+	// serverErrorBackoff is the delay before the first retry, doubling
+	// with each one.
+	serverErrorBackoff = 500 * time.Millisecond
+)
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// rateLimit is what GitHub told us about the limits of a client.
+type rateLimit struct {
+	mu sync.Mutex
+	// until is when we're allowed to make requests again
+	until time.Time
+}
+
+func (l *rateLimit) holdUntil(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.until) {
+		l.until = until
+	}
+}
+
+// wait blocks while we're rate limited, unless that takes too long.
+func (l *rateLimit) wait(ctx context.Context) error {
+	l.mu.Lock()
+	delay := time.Until(l.until)
+	l.mu.Unlock()
+	if delay <= 0 || delay > maxRateLimitWait {
+		return nil
+	}
+	return sleep(ctx, delay)
+}
+
+// observe remembers the limits in the headers of a response. It returns how
+// long to wait before retrying if the request was rejected by the secondary
+// rate limit.
+func (l *rateLimit) observe(resp *http.Response) time.Duration {
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			delay := time.Duration(seconds) * time.Second
+			l.holdUntil(time.Now().Add(delay))
+			return delay
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			l.holdUntil(time.Unix(reset, 0))
+		}
+	}
+	return 0
+}
+
+// rateLimits holds the limits of each client, so clients created for the
+// same installation share them.
+type rateLimits struct {
+	mu       sync.Mutex
+	byClient map[string]*rateLimit
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{byClient: map[string]*rateLimit{}}
+}
+
+func (ls *rateLimits) get(client string) *rateLimit {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if l, ok := ls.byClient[client]; ok {
+		return l
+	}
+	l := &rateLimit{}
+	ls.byClient[client] = l
+	return l
+}
+
+// rateLimitTransport holds off requests while a client is rate limited and
+// retries requests that can safely be sent again.
+type rateLimitTransport struct {
+	next  http.RoundTripper
+	limit *rateLimit
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.limit.wait(req.Context()); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if err != nil {
+			return resp, err
+		}
+
+		delay := t.limit.observe(resp)
+		if delay == 0 && resp.StatusCode >= http.StatusInternalServerError {
+			delay = serverErrorBackoff << uint(attempt)
+		}
+		// Other requests may have had an effect anyway, they're left to the
+		// caller which knows whether sending them again is safe
+		if !idempotentMethods[req.Method] {
+			return resp, nil
+		}
+		if delay == 0 || delay > maxRateLimitWait || attempt >= serverErrorRetries {
+			return resp, nil
+		}
+
+		retry, ok := rewind(req)
+		if !ok {
+			return resp, nil
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		req = retry
+	}
+}
+
+// rewind gives us a copy of req that can be sent again.
+func rewind(req *http.Request) (*http.Request, bool) {
+	retry := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return retry, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	retry.Body = body
+	return retry, true
+}
+
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+package githubwebhook
+
+import (
+	"context"
+	"fmt"
+
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// update points an existing environment at a newly pushed commit.
+type update struct {
+	owner  string
+	name   string
+	sha    string
+	branch string
+	pr     prPointer
+	// fork is set for PRs from forks
+	fork bool
+}
+
+func (u *update) Act(webhook *WebhookHandler) error {
+	ctx := context.Background()
+	ns, err := webhook.environment(ctx, u.pr)
+	if err != nil || ns == nil {
+		// Not deployed
+		return err
+	}
+	nn := types.NamespacedName{Name: releaseName, Namespace: ns.Name}
+
+	var refRelease deployv1alpha1.RefRelease
+	if err := webhook.k8s.Get(ctx, nn, &refRelease); err != nil {
+		// Not deployed
+		return client.IgnoreNotFound(err)
+	}
+	if u.fork {
+		if err := webhook.checkFork(ctx, u.owner, u.name, u.pr.number, u.sha); err != nil {
+			return err
+		}
+	}
+	refRelease.Spec.Ref.Sha = u.sha
+	refRelease.Spec.Ref.Branch = u.branch
+	refRelease.Spec.Ref.Pinned = webhook.pinned(u.fork)
+	if err := webhook.k8s.Update(ctx, &refRelease); err != nil {
+		return errors.Wrap(err, "couldn't update RefRelease")
+	}
+
+	var gd deployv1alpha1.GithubDeployment
+	if err := webhook.k8s.Get(ctx, nn, &gd); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	// The controller creates a deployment for the new sha
+	gd.Spec.Sha = u.sha
+	if err := webhook.k8s.Update(ctx, &gd); err != nil {
+		return errors.Wrap(err, "couldn't update GithubDeployment")
+	}
+
+	return nil
+}
+
+func (u *update) Describe() string {
+	return fmt.Sprintf("Updating PR %d from %d to %s", u.pr.number, u.pr.id, u.sha)
+}
@@ -1,33 +1,41 @@
 package githubwebhook
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"regexp"
-	"strings"
-	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/go-logr/logr"
 	gh "github.com/google/go-github/v31/github"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // +kubebuilder:rbac:groups=deploy.properator.io,resources=refreleases,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=deploy.properator.io,resources=githubdeployments,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get
 
 // Webhook is the state we need to handle webhook events
 type Webhook struct {
 	webhookSecretKey []byte
-	events           chan interface{}
+	queue            *Queue
+	// archive is optional
+	archive *Archive
+	log     logr.Logger
 }
 
-// NewWebhook creates the state needed for a webhook
-func NewWebhook(key []byte, events chan interface{}) Webhook {
+// NewWebhook creates the state needed for a webhook. Deliveries are saved to
+// archive if it isn't nil.
+func NewWebhook(key []byte, queue *Queue, archive *Archive, log logr.Logger) Webhook {
 	return Webhook{
 		key,
-		events,
+		queue,
+		archive,
+		log,
 	}
 }
 
@@ -36,61 +44,237 @@ func NewWebhook(key []byte, events chan interface{}) Webhook {
 type WebhookWorker struct {
 	k8s         client.Client
 	makeHandler func(installationID int64) (*WebhookHandler, error)
-	log         logr.Logger
+	clients     *ClientCache
+	// gitlab is only set if GitLab is enabled
+	gitlab *WebhookHandler
+	config *Config
+	recent *recentActions
+	log    logr.Logger
 }
 
 // WebhookHandler handles a specific event
 type WebhookHandler struct {
 	k8s      client.Client
-	ghCli    *gh.Client
-	username string
-	log      logr.Logger
+	provider provider
+	// installationID is only set for GitHub
+	installationID int64
+	username       string
+	config         *Config
+	log            logr.Logger
 }
 
 // NewWebhookWorker creates the state needed for a worker
-func NewWebhookWorker(k8s client.Client, makeGhcli ClientForInstallation, username string, log logr.Logger) WebhookWorker {
+func NewWebhookWorker(k8s client.Client, setup GhCliSetup, config Config, log logr.Logger) WebhookWorker {
 	makeHandler := func(installationID int64) (*WebhookHandler, error) {
-		ghcli, err := makeGhcli(installationID)
+		ghcli, err := setup.CliForInstall(installationID)
 		if err != nil {
 			return nil, err
 		}
-		return &WebhookHandler{k8s, ghcli, username, log}, nil
+		return &WebhookHandler{k8s, &githubProvider{ghcli, setup.Clients.ForRepo}, installationID, setup.Username, &config, log}, nil
 	}
 	return WebhookWorker{
 		k8s,
 		makeHandler,
+		setup.Clients,
+		nil,
+		&config,
+		newRecentActions(config.Debounce),
 		log,
 	}
 }
 
+// EnableGitlab handles GitLab events, answering to the user owning the token
+// of cli.
+func (webhook *WebhookWorker) EnableGitlab(ctx context.Context, cli *gitlab.Client) error {
+	user, err := cli.CurrentUser(ctx)
+	if err != nil {
+		return errors.Wrap(err, "problem getting username from GitLab")
+	}
+	webhook.gitlab = &WebhookHandler{
+		k8s:      webhook.k8s,
+		provider: &gitlabProvider{cli},
+		username: user.Username,
+		config:   webhook.config,
+		log:      webhook.log,
+	}
+	return nil
+}
+
 // HasInstallation covers all relevant webhook events
 type HasInstallation interface {
 	GetInstallation() *gh.Installation
 }
 
-// Worker handles github events from a channel
-func (webhook *WebhookWorker) Worker(wg *sync.WaitGroup, events <-chan interface{}) {
-	defer wg.Done()
-	for event := range events {
-		hasInstallation, ok := event.(HasInstallation)
-		if !ok {
-			webhook.log.Error(errors.New("couldn't understand webhook event, no installation present"), "")
-			continue
+// complete marks an event as done in the queue or, if handling it failed,
+// dead letters it.
+func (webhook *WebhookWorker) complete(queue *Queue, stored Event, err error) {
+	ctx := context.Background()
+	if err != nil {
+		webhook.log.Error(err, "Giving up on event", "event", stored.ID)
+		deadLettersTotal.Inc()
+		if err := queue.DeadLetter(ctx, stored, err); err != nil {
+			webhook.log.Error(err, "couldn't dead letter event", "event", stored.ID)
 		}
-		installationID := hasInstallation.GetInstallation().GetID()
-		handler, err := webhook.makeHandler(installationID)
-		if err != nil {
-			webhook.log.Error(err, "couldn't initialize handler for installation %v", installationID)
+		return
+	}
+	if err := queue.Done(ctx, stored); err != nil {
+		webhook.log.Error(err, "couldn't mark event as done", "event", stored.ID)
+	}
+}
+
+// work handles a stored event. It returns an error if the event should be
+// kept for later, or a retryLater if it should be retried.
+func (webhook *WebhookWorker) work(stored Event) error {
+	event, err := stored.Parse()
+	if err != nil {
+		webhook.log.Error(err, "couldn't parse stored event", "event", stored.ID)
+		return nil
+	}
+	handler, err := webhook.handlerFor(event)
+	if err != nil {
+		return err
+	}
+	if handler == nil {
+		webhook.log.Error(errors.New("couldn't understand webhook event, no installation present"), "")
+		return nil
+	}
+	return webhook.handle(handler, event)
+}
+
+// handlerFor gives us a handler for the provider an event came from. It's
+// nil if we can't handle the event.
+func (webhook *WebhookWorker) handlerFor(event interface{}) (*WebhookHandler, error) {
+	switch event.(type) {
+	case *gitlab.NoteEvent, *gitlab.MergeRequestEvent:
+		return webhook.gitlab, nil
+	}
+	hasInstallation, ok := event.(HasInstallation)
+	if !ok {
+		return nil, nil
+	}
+	installationID := hasInstallation.GetInstallation().GetID()
+	switch event.(type) {
+	case *gh.InstallationEvent, *gh.InstallationRepositoriesEvent:
+		// The installation or its repos changed
+		if webhook.clients != nil {
+			webhook.clients.ForgetInstallation(installationID)
 		}
-		if action := handler.handleEvent(event); action != nil {
-			if desc := action.Describe(); desc != "" {
-				webhook.log.Info(desc)
+	}
+	handler, err := webhook.makeHandler(installationID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't initialize handler for installation %v", installationID)
+	}
+	return handler, nil
+}
+
+// Replay handles an event outside of the queue. With dryRun, it only logs
+// what would be done.
+func (webhook *WebhookWorker) Replay(stored Event, dryRun bool) error {
+	event, err := stored.Parse()
+	if err != nil {
+		return errors.Wrap(err, "couldn't parse event")
+	}
+	handler, err := webhook.handlerFor(event)
+	if err != nil {
+		return err
+	}
+	if handler == nil {
+		return errors.New("couldn't understand webhook event, no installation present")
+	}
+	if !dryRun {
+		return retryInPlace(webhook.handle(handler, event))
+	}
+
+	action, err := handler.handleEvent(event)
+	if err != nil {
+		return err
+	}
+	if action == nil {
+		webhook.log.Info("Nothing to do")
+		return nil
+	}
+	var details string
+	if d, ok := action.(detailed); ok {
+		details = d.Details()
+	}
+	webhook.log.Info("Would act", "action", action.Describe(), "type", fmt.Sprintf("%T", action), "details", details)
+	return nil
+}
+
+// handle acts on an event, reporting back to the comment that triggered it.
+// Errors are only returned if retrying later might help. Retries of the
+// action are returned as retryLater.
+func (webhook *WebhookWorker) handle(handler *WebhookHandler, event interface{}) error {
+	ctx := context.Background()
+	comment, isComment := triggerOf(event)
+
+	action, err := handler.handleEvent(event)
+	if isTransient(err) {
+		return err
+	}
+	if err != nil {
+		eventsTotal.WithLabelValues(eventType(event), "rejected").Inc()
+		webhook.log.Error(err, "Couldn't understand event")
+		if isComment {
+			if err := handler.reject(ctx, comment, err); err != nil {
+				webhook.log.Error(err, "Couldn't reject comment")
 			}
-			if err := action.Act(handler); err != nil {
+		}
+		return nil
+	}
+	eventsTotal.WithLabelValues(eventType(event), actionName(action)).Inc()
+	if action == nil {
+		return nil
+	}
+
+	desc := action.Describe()
+	if desc == "" {
+		// Nothing to report
+		return webhook.act(handler, action, func(err error) error {
+			if err != nil {
 				webhook.log.Error(err, "Error doing an action")
+				if isTransient(err) {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	key, fp := eventKey(event), fingerprint(action)
+	if webhook.recent.isRepeat(key, fp, time.Now()) {
+		webhook.log.Info("Skipping repeated action", "action", desc)
+		if isComment {
+			if err := handler.notice(ctx, comment); err != nil {
+				webhook.log.Error(err, "Couldn't react to comment")
 			}
 		}
+		return nil
 	}
+	webhook.log.Info(desc)
+
+	var r *reply
+	if isComment {
+		if r, err = handler.acknowledge(ctx, comment, desc); err != nil {
+			webhook.log.Error(err, "Couldn't acknowledge comment")
+		}
+	}
+	return webhook.act(handler, action, func(actErr error) error {
+		if actErr != nil {
+			webhook.log.Error(actErr, "Error doing an action")
+			webhook.recent.forget(key)
+		} else {
+			webhook.recent.record(key, fp, time.Now())
+		}
+		if r != nil {
+			if err := handler.finish(ctx, r, action, actErr); err != nil {
+				webhook.log.Error(err, "Couldn't report outcome")
+			}
+		}
+		if isTransient(actErr) {
+			return actErr
+		}
+		return nil
+	})
 }
 
 func (webhook *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -101,54 +285,113 @@ func (webhook *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	event, err := gh.ParseWebHook(gh.WebHookType(r), payload)
-	if err != nil {
+	webhook.receive(w, r, Event{
+		Type:       gh.WebHookType(r),
+		DeliveryID: gh.DeliveryID(r),
+		ReceivedAt: time.Now(),
+		Payload:    payload,
+	})
+}
+
+// receive archives and queues a validated delivery.
+func (webhook *Webhook) receive(w http.ResponseWriter, r *http.Request, event Event) {
+	if _, err := event.Parse(); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	select {
-	case webhook.events <- event:
+	if err := checkDeliveryID(event.DeliveryID); err != nil {
+		webhook.log.Info("Rejecting delivery", "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
 		return
-	default:
+	}
+
+	if webhook.archive != nil {
+		if err := webhook.archive.Save(event); err != nil {
+			webhook.log.Error(err, "couldn't archive event", "delivery", event.DeliveryID)
+		}
+	}
+
+	if !handledEvents[event.Type] {
+		return
+	}
+
+	// Only acknowledge events once they're safely stored
+	added, err := webhook.queue.Add(r.Context(), event)
+	if err != nil {
+		webhook.log.Error(err, "couldn't queue event", "delivery", event.DeliveryID)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
+	if !added {
+		webhook.log.Info("Skipping delivery we've already seen", "delivery", event.DeliveryID)
+	}
 }
 
-func containsCommand(name, body, command string, otherCommands ...string) bool {
-	commands := append([]string{command}, otherCommands...)
-	pat := fmt.Sprintf("@%s[[:space:]]+(?:%s)", name, strings.Join(commands, "|"))
-	matched, _ := regexp.MatchString(pat, body)
-	return matched
+func parseComment(username string, comment *gh.IssueCommentEvent, authorize authorizer) (action, error) {
+	t, ok := triggerOf(comment)
+	if !ok {
+		return nil, nil
+	}
+	return parseCommandActions(username, comment.GetComment().GetBody(), t.owner, t.repo, t.pr, authorize)
 }
 
-func parseComment(username string, comment *gh.IssueCommentEvent) action {
-	if !comment.Issue.IsPullRequest() {
-		return nil
-	}
-	pr := prPointer{
-		number: comment.GetIssue().GetNumber(),
-		id:     comment.GetRepo().GetID(),
+// parseCommandActions gives us the actions for the commands in a comment on
+// pr in owner/name.
+func parseCommandActions(
+	username, body, owner, name string, pr prPointer, authorize authorizer,
+) (action, error) {
+	commands, err := parseCommands(username, body)
+	if err != nil {
+		return nil, err
 	}
-	body := comment.Comment.GetBody()
 
-	if containsCommand(username, body, "deploy") {
-		return &create{
-			owner: comment.GetRepo().GetOwner().GetLogin(),
-			name:  comment.GetRepo().GetName(),
-			pr:    pr,
+	var actions sequence
+	for _, cmd := range commands {
+		if err := authorize(cmd); err != nil {
+			return nil, err
 		}
-	}
-	if containsCommand(username, body, "drop", "delete") {
-		return &drop{
-			pr: pr,
+		switch cmd := cmd.(type) {
+		case deployCommand:
+			actions = append(actions, &create{
+				owner: owner,
+				name:  name,
+				path:  cmd.path,
+				ttl:   cmd.ttl,
+				pr:    pr,
+			})
+		case dropCommand:
+			actions = append(actions, &drop{
+				pr: pr,
+			})
+		case redeployCommand:
+			actions = append(actions, &redeploy{
+				owner: owner,
+				name:  name,
+				pr:    pr,
+			})
+		case statusCommand:
+			actions = append(actions, &status{
+				pr: pr,
+			})
+		case extendCommand:
+			actions = append(actions, &extend{
+				pr:  pr,
+				ttl: cmd.ttl,
+			})
 		}
 	}
-	return &noopAction{}
+	switch len(actions) {
+	case 0:
+		return &noopAction{}, nil
+	case 1:
+		return actions[0], nil
+	default:
+		return actions, nil
+	}
 }
 
-func parsePREvent(event *gh.PullRequestEvent) action {
+func parsePREvent(event *gh.PullRequestEvent, config *Config) action {
 	pr := prPointer{
 		number: event.GetPullRequest().GetNumber(),
 		id:     event.GetRepo().GetID(),
@@ -163,18 +406,59 @@ func parsePREvent(event *gh.PullRequestEvent) action {
 	case "closed":
 		return &drop{
 			pr: pr,
+			// Merged PRs can't be reopened
+			remember: !event.GetPullRequest().GetMerged(),
+		}
+	case "reopened":
+		return &restore{
+			pr: pr,
+		}
+	case "labeled", "unlabeled":
+		if config.DeployLabel == "" || event.GetLabel().GetName() != config.DeployLabel {
+			return nil
+		}
+		if event.GetPullRequest().GetState() != "open" {
+			return nil
+		}
+		if event.GetAction() == "unlabeled" {
+			return &drop{
+				pr: pr,
+			}
+		}
+		return &create{
+			owner: event.GetRepo().GetOwner().GetLogin(),
+			name:  event.GetRepo().GetName(),
+			pr:    pr,
+		}
+	case "synchronize":
+		return &update{
+			owner:  event.GetRepo().GetOwner().GetLogin(),
+			name:   event.GetRepo().GetName(),
+			sha:    event.GetPullRequest().GetHead().GetSHA(),
+			branch: event.GetPullRequest().GetHead().GetRef(),
+			pr:     pr,
+			fork:   event.GetPullRequest().GetHead().GetRepo().GetID() != event.GetRepo().GetID(),
 		}
 	default:
 		return nil
 	}
 }
-func (webhook *WebhookHandler) handleEvent(event interface{}) action {
+func (webhook *WebhookHandler) handleEvent(event interface{}) (action, error) {
+	t, _ := triggerOf(event)
 	switch event := event.(type) {
 	case *gh.IssueCommentEvent:
-		return parseComment(webhook.username, event)
+		return parseComment(webhook.username, event, webhook.authorize(context.Background(), t))
+	case *gitlab.NoteEvent:
+		return parseNote(webhook.username, event, webhook.authorize(context.Background(), t))
+	case *gitlab.MergeRequestEvent:
+		return parseMergeRequestEvent(event, webhook.config), nil
 	case *gh.PullRequestEvent:
-		return parsePREvent(event)
+		return parsePREvent(event, webhook.config), nil
+	case *gh.InstallationEvent:
+		return parseInstallationEvent(event), nil
+	case *gh.InstallationRepositoriesEvent:
+		return parseInstallationRepositoriesEvent(event), nil
 	default:
-		return nil
+		return nil, nil
 	}
 }
@@ -1,10 +1,29 @@
 package githubwebhook
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-github/v31/github"
+	deployv1alpha1 "github.com/michaelbeaumont/properator/api/v1alpha1"
+	"github.com/michaelbeaumont/properator/pkg/gitlab"
+	"github.com/michaelbeaumont/properator/pkg/utils"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 var (
@@ -12,17 +31,60 @@ var (
 	name  = "test"
 )
 
-func TestContainsCommand(t *testing.T) {
-	assert.True(t, containsCommand("name", "@name    deploy", "deploy"))
-	assert.True(t, containsCommand("name", "@name    delete", "deploy", "delete"))
-	assert.False(t, containsCommand("name", "@name  f  deploy", "deploy"))
+func TestParseCommands(t *testing.T) {
+	cmds, err := parseCommands("name", "@name    deploy")
+	assert.NoError(t, err)
+	assert.Equal(t, []command{deployCommand{}}, cmds)
+
+	cmds, err = parseCommands("name", "@name    delete")
+	assert.NoError(t, err)
+	assert.Equal(t, []command{dropCommand{}}, cmds)
+
+	_, err = parseCommands("name", "@name  f  deploy")
+	assert.Error(t, err)
+
+	cmds, err = parseCommands("name", "thanks!\n> @name deploy\n@name deploy --path='deploy/a b'\n@name drop\n@named deploy")
+	assert.NoError(t, err)
+	assert.Equal(t, []command{deployCommand{path: "deploy/a b"}, dropCommand{}}, cmds)
+
+	cmds, err = parseCommands("name", "@name status")
+	assert.NoError(t, err)
+	assert.Equal(t, []command{statusCommand{}}, cmds)
+
+	cmds, err = parseCommands("name", "@name deploy path=deploy")
+	assert.NoError(t, err)
+	assert.Equal(t, []command{deployCommand{path: "deploy"}}, cmds)
+
+	_, err = parseCommands("name", "@name deploy --pth=deploy")
+	assert.EqualError(t, err, "unknown argument(s) for deploy: pth")
+
+	_, err = parseCommands("name", "@name deploy deploy")
+	assert.Error(t, err)
+
+	_, err = parseCommands("name", "@name deploy --path=\"deploy")
+	assert.Error(t, err)
+
+	cmds, err = parseCommands("name", "@name deploy ttl=72h\n@name extend\n@name extend --ttl=1h")
+	assert.NoError(t, err)
+	assert.Equal(t, []command{
+		deployCommand{ttl: 72 * time.Hour}, extendCommand{}, extendCommand{ttl: time.Hour},
+	}, cmds)
+
+	_, err = parseCommands("name", "@name extend ttl=3d")
+	assert.Error(t, err)
+}
+
+func allowAll(command) error {
+	return nil
 }
 
 func TestParseComment(t *testing.T) {
 	num := 23
 	id := int64(12345)
 	body := "@properator deploy"
+	created := "created"
 	commentEvent := github.IssueCommentEvent{
+		Action: &created,
 		Issue: &github.Issue{
 			Number: &num,
 		},
@@ -37,10 +99,622 @@ func TestParseComment(t *testing.T) {
 			Name: &name,
 		},
 	}
-	parsed := parseComment("properator", &commentEvent)
+	parsed, err := parseComment("properator", &commentEvent, allowAll)
+	assert.NoError(t, err)
 	assert.Nil(t, parsed, "issue should be ignored without pull_request")
 	commentEvent.Issue.PullRequestLinks = &github.PullRequestLinks{}
-	parsed = parseComment("properator", &commentEvent)
+	parsed, err = parseComment("properator", &commentEvent, allowAll)
+	assert.NoError(t, err)
 	action := &create{owner: owner, name: name, pr: prPointer{number: num, id: id}}
 	assert.Equal(t, action, parsed)
+
+	for _, edited := range []string{"edited", "deleted"} {
+		commentEvent.Action = &edited
+		parsed, err = parseComment("properator", &commentEvent, allowAll)
+		assert.NoError(t, err)
+		assert.Nil(t, parsed, "%s comments should be ignored", edited)
+		_, ok := triggerOf(&commentEvent)
+		assert.False(t, ok, "%s comments aren't replied to", edited)
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	namespace := prPointer{id: 12345, number: 23}.defaultNamespace()
+	succeeded := outcome("Creating PR 23 from 12345", "", namespace, nil)
+	assert.Contains(t, succeeded, ":white_check_mark: Creating PR 23 from 12345")
+	assert.Contains(t, succeeded, "| `properator-github-webhook-12345-23` | `github-webhook` |")
+
+	failed := outcome("Creating PR 23 from 12345", "", "", errors.New("no such branch"))
+	assert.Contains(t, failed, ":x: Creating PR 23 from 12345 failed")
+	assert.Contains(t, failed, "```\nno such branch\n```")
+	assert.NotContains(t, failed, "| Namespace |")
+}
+
+func TestParseCommentDenied(t *testing.T) {
+	num := 23
+	id := int64(12345)
+	body := "@properator status\n@properator drop"
+	created := "created"
+	commentEvent := github.IssueCommentEvent{
+		Action: &created,
+		Issue: &github.Issue{
+			Number:           &num,
+			PullRequestLinks: &github.PullRequestLinks{},
+		},
+		Comment: &github.IssueComment{
+			Body: &body,
+		},
+		Repo: &github.Repository{
+			ID: &id,
+		},
+	}
+	denyDrop := func(cmd command) error {
+		if cmd.verb() == "drop" {
+			return &permissionError{"someone", cmd.verb(), "write permission is needed"}
+		}
+		return nil
+	}
+	_, err := parseComment("properator", &commentEvent, denyDrop)
+	assert.EqualError(t, err, "@someone can't use drop: write permission is needed")
+}
+
+func TestParsePermissions(t *testing.T) {
+	permissions, err := ParsePermissions(DefaultPermissions)
+	assert.NoError(t, err)
+	assert.Equal(t, "write", permissions["deploy"])
+	assert.Equal(t, "read", permissions["status"])
+
+	_, err = ParsePermissions("deploy=maintainer")
+	assert.Error(t, err)
+	_, err = ParsePermissions("deplyo=write")
+	assert.Error(t, err)
+
+	permissions, err = ParsePermissions("deploy=admin,delete=admin")
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", permissions["deploy"])
+	assert.Equal(t, "admin", permissions["drop"], "aliases should set the permission of their command")
+	assert.NotContains(t, permissions, "delete")
+	assert.Equal(t, "read", permissions["status"], "unlisted commands should keep their default")
+}
+
+func TestParsePREventLabel(t *testing.T) {
+	num := 23
+	id := int64(12345)
+	action := "labeled"
+	label := "preview"
+	state := "open"
+	event := github.PullRequestEvent{
+		Action: &action,
+		Label:  &github.Label{Name: &label},
+		PullRequest: &github.PullRequest{
+			Number: &num,
+			State:  &state,
+		},
+		Repo: &github.Repository{
+			ID: &id,
+			Owner: &github.User{
+				Login: &owner,
+			},
+			Name: &name,
+		},
+	}
+	pr := prPointer{number: num, id: id}
+
+	assert.Nil(t, parsePREvent(&event, &Config{}), "labels should be ignored without DeployLabel")
+
+	config := Config{DeployLabel: "preview"}
+	assert.Equal(t, &create{owner: owner, name: name, pr: pr}, parsePREvent(&event, &config))
+
+	action = "unlabeled"
+	assert.Equal(t, &drop{pr: pr}, parsePREvent(&event, &config))
+
+	label = "other"
+	assert.Nil(t, parsePREvent(&event, &config))
+}
+
+func TestOwnsNamespace(t *testing.T) {
+	repos := map[int64]bool{12345: true}
+	owned := func(name string, annotations, labels map[string]string) bool {
+		ns := v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations, Labels: labels}}
+		return ownsNamespace(&ns, 77, repos)
+	}
+	ours := map[string]string{EnvironmentAnnotation: "true"}
+
+	assert.True(t, owned("anything", ours, map[string]string{repoLabel: "12345"}))
+	assert.True(t, owned("anything", ours, map[string]string{repoLabel: "1", installationLabel: "77"}))
+	assert.True(t, owned("properator-github-webhook-12345-2", ours, nil))
+	assert.False(t, owned("properator-github-webhook-12345-2", nil, nil))
+	assert.False(t, owned("anything", ours, map[string]string{repoLabel: "1"}))
+	assert.False(t, owned("anything", ours, map[string]string{repoLabel: "12345", providerLabel: "gitlab"}))
+}
+
+func TestIsTransient(t *testing.T) {
+	assert.False(t, isTransient(nil))
+	assert.False(t, isTransient(errors.New("no")))
+	assert.True(t, isTransient(errors.Wrap(&github.RateLimitError{}, "couldn't")))
+	assert.True(t, isTransient(&github.ErrorResponse{Response: &http.Response{StatusCode: 502}}))
+	assert.False(t, isTransient(&github.ErrorResponse{Response: &http.Response{StatusCode: 422}}))
+	assert.True(t, isTransient(apierrors.NewConflict(schema.GroupResource{}, "ns", errors.New("conflict"))))
+	assert.False(t, isTransient(apierrors.NewNotFound(schema.GroupResource{}, "ns")))
+}
+
+func TestRecentActions(t *testing.T) {
+	now := time.Now()
+	recent := newRecentActions(time.Minute)
+	assert.False(t, recent.isRepeat("pr-1-2", "Deploying", now))
+
+	recent.record("pr-1-2", "Deploying", now)
+	assert.True(t, recent.isRepeat("pr-1-2", "Deploying", now.Add(time.Second)))
+	assert.False(t, recent.isRepeat("pr-1-3", "Deploying", now.Add(time.Second)))
+	assert.False(t, recent.isRepeat("pr-1-2", "Dropping", now.Add(time.Second)))
+	assert.False(t, recent.isRepeat("pr-1-2", "Deploying", now.Add(time.Minute)))
+
+	recent.forget("pr-1-2")
+	assert.False(t, recent.isRepeat("pr-1-2", "Deploying", now.Add(time.Second)))
+}
+
+func TestFingerprint(t *testing.T) {
+	pr := prPointer{id: 1, number: 2}
+	parse := func(body string) string {
+		a, err := parseCommandActions("properator", body, "owner", "repo", pr, allowAll)
+		assert.NoError(t, err)
+		return fingerprint(a)
+	}
+
+	assert.Equal(t, parse("@properator deploy path=a"), parse("@properator deploy path=a"))
+	assert.NotEqual(t, parse("@properator deploy path=a"), parse("@properator deploy path=b"))
+	assert.NotEqual(t, parse("@properator deploy"), parse("@properator deploy ttl=1h"))
+	assert.NotEqual(t, parse("@properator extend"), parse("@properator extend ttl=1h"))
+	assert.NotEqual(t, parse("@properator deploy\n@properator drop"), parse("@properator deploy"))
+	assert.Empty(t, parse("@properator status"), "status is never skipped")
+	assert.Equal(t, parse("@properator deploy\n@properator status"), parse("@properator deploy"))
+
+	first, second := int64(1), int64(1)
+	assert.Equal(t,
+		fingerprint(&cleanup{repos: []*github.Repository{{ID: &first}}}),
+		fingerprint(&cleanup{repos: []*github.Repository{{ID: &second}}}),
+		"pointers are compared by what they point to",
+	)
+	assert.NotEqual(t,
+		fingerprint(&create{pr: pr, branch: "a"}),
+		fingerprint(&create{pr: prPointer{provider: "gitlab", id: 1, number: 2}, branch: "a"}),
+	)
+}
+
+func TestActionName(t *testing.T) {
+	assert.Equal(t, "none", actionName(nil))
+	assert.Equal(t, "noop", actionName(&noopAction{}))
+	assert.Equal(t, "create", actionName(&create{}))
+	assert.Equal(t, "create+drop", actionName(sequence{&create{}, &drop{}}))
+}
+
+func TestReadyz(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	failing := func(ctx context.Context) error { return errors.New("unreachable") }
+
+	rec := httptest.NewRecorder()
+	Readyz(map[string]Check{"a": ok, "b": ok}).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	Readyz(map[string]Check{"a": ok, "b": failing}).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "b: unreachable")
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch {
+		case r.URL.Path == "/abuse" && calls == 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusForbidden)
+		case calls == 1:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	cli := &http.Client{Transport: &rateLimitTransport{http.DefaultTransport, &rateLimit{}}}
+	do := func(method, path string) int {
+		calls = 0
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader("{}"))
+		assert.NoError(t, err)
+		resp, err := cli.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/"), "idempotent requests are retried")
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, http.StatusBadGateway, do(http.MethodPost, "/"), "other requests aren't")
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/abuse"), "requests hitting the abuse limit are retried")
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/abuse"), "unless they aren't idempotent")
+	assert.Equal(t, 1, calls)
+}
+
+func TestEndpoints(t *testing.T) {
+	assert.Equal(t, "git@github.com:owner/repo", Endpoints{}.GitURL("owner", "repo"))
+
+	endpoints, err := EnterpriseEndpoints("https://github.example.com/")
+	assert.NoError(t, err)
+	assert.True(t, endpoints.IsEnterprise())
+	assert.Equal(t, "https://github.example.com/api/v3/", endpoints.APIURL)
+	assert.Equal(t, "git@github.example.com:owner/repo", endpoints.GitURL("owner", "repo"))
+	assert.Equal(t, "https://github.example.com/owner/repo.git", endpoints.HTTPSURL("owner", "repo"))
+	assert.Equal(t, "https://github.com/owner/repo.git", Endpoints{}.HTTPSURL("owner", "repo"))
+
+	endpoints.SSHHost = "git.example.com:2222"
+	assert.Equal(t, "ssh://git@git.example.com:2222/owner/repo", endpoints.GitURL("owner", "repo"))
+
+	_, err = EnterpriseEndpoints("github.example.com")
+	assert.Error(t, err)
+
+	cli, err := endpoints.NewClient(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.example.com/api/v3/", cli.BaseURL.String())
+	assert.Equal(t, "https://github.example.com/api/uploads/", cli.UploadURL.String())
+
+	cli, err = Endpoints{APIURL: "https://api.example.com"}.NewClient(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.example.com/", cli.BaseURL.String(), "explicit API URLs are kept")
+}
+
+func TestParseGitlabEvents(t *testing.T) {
+	note, err := Event{Type: gitlab.NoteHook, Payload: []byte(`{
+		"user": {"username": "someone"},
+		"project": {"id": 42, "path_with_namespace": "group/sub/test"},
+		"object_attributes": {"id": 7, "note": "@properator deploy", "noteable_type": "MergeRequest"},
+		"merge_request": {"iid": 3}
+	}`)}.Parse()
+	assert.NoError(t, err)
+	pr := prPointer{provider: "gitlab", id: 42, number: 3}
+	parsed, err := parseNote("properator", note.(*gitlab.NoteEvent), allowAll)
+	assert.NoError(t, err)
+	assert.Equal(t, &create{owner: "group/sub", name: "test", pr: pr}, parsed)
+	assert.Equal(t, "gitlab-mr-42-3", eventKey(note))
+
+	assert.Equal(t, "properator-gitlab-42-3", pr.defaultNamespace())
+
+	updated, err := Event{Type: gitlab.NoteHook, Payload: []byte(`{
+		"user": {"username": "someone"},
+		"project": {"id": 42, "path_with_namespace": "group/sub/test"},
+		"object_attributes": {"id": 7, "note": "@properator deploy", "noteable_type": "MergeRequest", "action": "update"},
+		"merge_request": {"iid": 3}
+	}`)}.Parse()
+	assert.NoError(t, err)
+	parsed, err = parseNote("properator", updated.(*gitlab.NoteEvent), allowAll)
+	assert.NoError(t, err)
+	assert.Nil(t, parsed, "updated notes should be ignored")
+
+	mr, err := Event{Type: gitlab.MergeRequestHook, Payload: []byte(`{
+		"project": {"id": 42, "path_with_namespace": "group/sub/test"},
+		"object_attributes": {
+			"iid": 3, "state": "opened", "action": "update", "source_branch": "feature",
+			"last_commit": {"id": "abc"}
+		},
+		"changes": {"labels": {"previous": [], "current": [{"title": "preview"}]}}
+	}`)}.Parse()
+	assert.NoError(t, err)
+	event := mr.(*gitlab.MergeRequestEvent)
+	assert.Nil(t, parseMergeRequestEvent(event, &Config{}))
+	config := Config{DeployLabel: "preview"}
+	assert.Equal(t, &create{owner: "group/sub", name: "test", pr: pr}, parseMergeRequestEvent(event, &config))
+
+	event.Changes.Labels = nil
+	event.ObjectAttributes.OldRev = "def"
+	expected := &update{owner: "group/sub", name: "test", sha: "abc", branch: "feature", pr: pr}
+	assert.Equal(t, expected, parseMergeRequestEvent(event, &config))
+
+	event.ObjectAttributes.Action = "merge"
+	assert.Equal(t, &drop{pr: pr}, parseMergeRequestEvent(event, &config))
+
+	assert.Equal(t, "write", accessPermission(&gitlab.Member{AccessLevel: gitlab.DeveloperAccess, State: "active"}))
+	assert.Equal(t, "admin", accessPermission(&gitlab.Member{AccessLevel: gitlab.OwnerAccess, State: "active"}))
+	assert.Equal(t, "none", accessPermission(&gitlab.Member{AccessLevel: gitlab.GuestAccess, State: "active"}))
+	assert.Equal(t, "none", accessPermission(&gitlab.Member{AccessLevel: gitlab.MaintainerAccess, State: "blocked"}))
+}
+
+func TestClientCache(t *testing.T) {
+	created, lookups := 0, 0
+	newClient := func(int64) (*github.Client, error) {
+		created++
+		return github.NewClient(nil), nil
+	}
+	find := func(ctx context.Context, owner, repo string) (int64, error) {
+		lookups++
+		return 7, nil
+	}
+	now := time.Now()
+	cache := newClientCache(time.Hour, newClient, find)
+	cache.now = func() time.Time { return now }
+
+	first, err := cache.ForRepo(context.Background(), owner, name)
+	assert.NoError(t, err)
+	second, err := cache.ForInstallation(7)
+	assert.NoError(t, err)
+	assert.Same(t, first, second)
+	assert.Equal(t, 1, created)
+	assert.Equal(t, 1, lookups)
+
+	cache.ForgetInstallation(7)
+	_, err = cache.ForRepo(context.Background(), owner, name)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, created)
+	assert.Equal(t, 2, lookups)
+
+	now = now.Add(2 * time.Hour)
+	_, err = cache.ForRepo(context.Background(), owner, name)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, created)
+	assert.Equal(t, 3, lookups)
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	cli := http.Client{Transport: cache.forgetOnFailure(7, http.DefaultTransport)}
+	get := func() {
+		resp, err := cli.Get(server.URL)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		_, err = cache.ForRepo(context.Background(), owner, name)
+		assert.NoError(t, err)
+	}
+
+	get()
+	assert.Equal(t, 3, lookups, "successful calls keep the installation")
+
+	status = http.StatusNotFound
+	get()
+	assert.Equal(t, 4, created)
+	assert.Equal(t, 4, lookups, "the installation is gone from the repo")
+
+	status = http.StatusUnauthorized
+	get()
+	assert.Equal(t, 5, created)
+	assert.Equal(t, 5, lookups, "the installation is gone")
+}
+
+// approvingProvider approves a single commit.
+type approvingProvider struct {
+	provider
+	sha string
+}
+
+func (p approvingProvider) approved(_ context.Context, _, _ string, _ int, sha string) (bool, error) {
+	return sha == p.sha, nil
+}
+
+func TestCheckFork(t *testing.T) {
+	_, err := ParseForkPolicy("maybe")
+	assert.Error(t, err)
+
+	webhook := WebhookHandler{provider: approvingProvider{sha: "abc"}, config: &Config{}}
+	check := func(sha string) error {
+		return webhook.checkFork(context.Background(), owner, name, 2, sha)
+	}
+
+	assert.Error(t, check("abc"), "forks should be denied by default")
+
+	webhook.config.Forks = ForksApprove
+	assert.NoError(t, check("abc"))
+	assert.Error(t, check("def"))
+
+	webhook.config.Forks = ForksAllow
+	assert.NoError(t, check("def"))
+}
+
+func TestGitlabApproved(t *testing.T) {
+	resets := "false"
+	approvedAt := `"2020-05-01T13:00:00Z"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/api/v4/") {
+		case "projects/" + owner + "/" + name + "/merge_requests/2":
+			_, _ = w.Write([]byte(`{"iid": 2, "sha": "def"}`))
+		case "projects/" + owner + "/" + name:
+			_, _ = w.Write([]byte(`{"id": 1, "reset_approvals_on_push": ` + resets + `}`))
+		case "projects/" + owner + "/" + name + "/merge_requests/2/versions":
+			_, _ = w.Write([]byte(`[
+				{"head_commit_sha": "def", "created_at": "2020-05-01T12:00:00Z"},
+				{"head_commit_sha": "abc", "created_at": "2020-05-01T11:00:00Z"}
+			]`))
+		case "projects/" + owner + "/" + name + "/merge_requests/2/approvals":
+			_, _ = w.Write([]byte(`{"approved_by": [{"user": {"username": "reviewer"}, "approved_at": ` + approvedAt + `}]}`))
+		case "users":
+			_, _ = w.Write([]byte(`[{"id": 3, "username": "reviewer"}]`))
+		case "projects/" + owner + "/" + name + "/members/all/3":
+			_, _ = w.Write([]byte(`{"access_level": 30, "state": "active"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := gitlab.NewClient(server.URL, "token", "")
+	assert.NoError(t, err)
+	p := &gitlabProvider{cli: cli}
+	approved := func(sha string) bool {
+		ok, err := p.approved(context.Background(), owner, name, 2, sha)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	assert.True(t, approved("def"), "approved after the push")
+	assert.False(t, approved("abc"), "only the head can be approved")
+
+	approvedAt = `"2020-05-01T11:30:00Z"`
+	assert.False(t, approved("def"), "approved before the push")
+
+	resets = "true"
+	assert.True(t, approved("def"), "approvals are reset on push")
+
+	resets, approvedAt = "null", "null"
+	assert.False(t, approved("def"), "neither can be told")
+}
+
+func TestGenerateKey(t *testing.T) {
+	_, err := ParseKeyType("dsa")
+	assert.Error(t, err)
+
+	for _, keyType := range []string{KeyRSA, KeyEd25519} {
+		keyPair, err := GenerateKey(keyType)
+		assert.NoError(t, err)
+
+		signer, err := ssh.ParsePrivateKey(keyPair.Private)
+		assert.NoError(t, err, keyType)
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(keyPair.Public)
+		assert.NoError(t, err, keyType)
+		assert.Equal(t, pub.Marshal(), signer.PublicKey().Marshal(), keyType)
+	}
+}
+
+func TestNamespaceConfig(t *testing.T) {
+	config, err := ParseNamespaceConfig([]byte(`
+nameTemplate: "{{ .Repo }}-pr-{{ .Number }}-{{ .Branch }}"
+labels:
+  team: web
+resourceQuota:
+  hard:
+    pods: "10"
+networkPolicy:
+  podSelector: {}
+  policyTypes: [Ingress]
+`))
+	assert.NoError(t, err)
+
+	name, err := config.name(NamespaceValues{Owner: "someone", Repo: "My_App", Number: 2, Branch: "feature/Login"})
+	assert.NoError(t, err)
+	assert.Equal(t, "my-app-pr-2-feature-login", name)
+
+	long := strings.Repeat("branch-", 20)
+	name, err = config.name(NamespaceValues{Repo: "app", Number: 2, Branch: long})
+	assert.NoError(t, err)
+	assert.Len(t, name, 63)
+	other, err := config.name(NamespaceValues{Repo: "app", Number: 2, Branch: long + "x"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, name, other, "truncated names should stay apart")
+
+	objects := config.environmentObjects("ns")
+	assert.Len(t, objects, 2)
+
+	_, err = ParseNamespaceConfig([]byte(`nameTemplate: "{{ .Nope }}"`))
+	assert.Error(t, err)
+	_, err = ParseNamespaceConfig([]byte(`nameTemplate: "{{ .Number }}"` + "\nlabels: {team: \"a b\"}"))
+	assert.Error(t, err)
+}
+
+func TestExpiry(t *testing.T) {
+	webhook := WebhookHandler{config: &Config{}}
+	assert.Nil(t, webhook.expiry(0))
+
+	webhook.config.TTL = 72 * time.Hour
+	webhook.config.IdleTTL = 24 * time.Hour
+	expiry := webhook.expiry(time.Hour)
+	assert.Equal(t, time.Hour, expiry.TTL.Duration)
+	assert.Equal(t, 24*time.Hour, expiry.Idle.Duration)
+
+	deployed := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	refRelease := deployv1alpha1.RefRelease{Spec: deployv1alpha1.RefReleaseSpec{Expiry: &deployv1alpha1.Expiry{
+		TTL:        &metav1.Duration{Duration: 72 * time.Hour},
+		Idle:       &metav1.Duration{Duration: 24 * time.Hour},
+		ExtendedAt: &metav1.Time{Time: deployed},
+	}}}
+	expires, ok := refRelease.ExpiresAt()
+	assert.True(t, ok)
+	assert.Equal(t, deployed.Add(24*time.Hour), expires, "idle environments expire first")
+
+	refRelease.Status.UpdatedAt = &metav1.Time{Time: deployed.Add(60 * time.Hour)}
+	expires, _ = refRelease.ExpiresAt()
+	assert.Equal(t, deployed.Add(72*time.Hour), expires, "new commits don't outlive the TTL")
+
+	refRelease.Spec.Expiry = nil
+	_, ok = refRelease.ExpiresAt()
+	assert.False(t, ok)
+}
+
+// headProvider has a single PR and accepts deploy keys.
+type headProvider struct {
+	provider
+	head pullRequest
+}
+
+func (p headProvider) pullRequest(context.Context, string, string, int) (pullRequest, error) {
+	return p.head, nil
+}
+
+func (p headProvider) addDeployKey(context.Context, string, string, []byte) (int64, error) {
+	return 7, nil
+}
+
+func (p headProvider) gitURL(string, string) string {
+	return ""
+}
+
+func TestRestore(t *testing.T) {
+	assert.NoError(t, os.Setenv(utils.NamespaceEnv, "properator"))
+	defer os.Unsetenv(utils.NamespaceEnv)
+
+	scheme := runtime.NewScheme()
+	assert.NoError(t, clientgoscheme.AddToScheme(scheme))
+	assert.NoError(t, deployv1alpha1.AddToScheme(scheme))
+
+	ctx := context.Background()
+	webhook := &WebhookHandler{
+		k8s:            fake.NewFakeClientWithScheme(scheme),
+		provider:       headProvider{head: pullRequest{branch: "feature", sha: "abc"}},
+		installationID: 1,
+		config:         &Config{},
+	}
+	pr := prPointer{id: 12345, number: 23}
+	released := func() *deployv1alpha1.RefRelease {
+		ns, err := webhook.environment(ctx, pr)
+		assert.NoError(t, err)
+		if ns == nil {
+			return nil
+		}
+		var refRelease deployv1alpha1.RefRelease
+		assert.NoError(t, webhook.k8s.Get(ctx, types.NamespacedName{Name: releaseName, Namespace: ns.Name}, &refRelease))
+		return &refRelease
+	}
+
+	assert.NoError(t, (&create{owner: owner, name: name, path: "deploy", pr: pr}).Act(webhook))
+	assert.Equal(t, "deploy", released().Spec.Path)
+
+	// Closing without remembering, like merged PRs
+	assert.NoError(t, (&drop{pr: pr}).Act(webhook))
+	assert.Nil(t, released())
+	assert.NoError(t, (&restore{pr: pr}).Act(webhook))
+	assert.Nil(t, released(), "nothing should be restored without a record")
+
+	assert.NoError(t, (&create{owner: owner, name: name, path: "deploy", pr: pr}).Act(webhook))
+	assert.NoError(t, (&drop{pr: pr, remember: true}).Act(webhook))
+	assert.Nil(t, released())
+	nn, err := recordKey(pr)
+	assert.NoError(t, err)
+	var record v1.ConfigMap
+	assert.NoError(t, webhook.k8s.Get(ctx, nn, &record))
+	assert.Equal(t, "deploy", record.Data["path"])
+
+	assert.NoError(t, (&restore{pr: pr}).Act(webhook))
+	restored := released()
+	if assert.NotNil(t, restored) {
+		assert.Equal(t, "deploy", restored.Spec.Path)
+		assert.Equal(t, owner, restored.Spec.Repo.Owner)
+		assert.Equal(t, "abc", restored.Spec.Ref.Sha)
+	}
+	assert.True(t, apierrors.IsNotFound(webhook.k8s.Get(ctx, nn, &record)), "the record should be gone once restored")
+
+	assert.NoError(t, (&drop{pr: pr, remember: true}).Act(webhook))
+	assert.NoError(t, pruneRecords(ctx, webhook.k8s, time.Now().Add(-time.Hour)))
+	assert.NoError(t, webhook.k8s.Get(ctx, nn, &record), "recent records should be kept")
+	assert.NoError(t, pruneRecords(ctx, webhook.k8s, time.Now().Add(time.Hour)))
+	assert.True(t, apierrors.IsNotFound(webhook.k8s.Get(ctx, nn, &record)), "old records should be pruned")
 }
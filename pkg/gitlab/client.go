@@ -0,0 +1,371 @@
+// Package gitlab is a small client for the parts of the GitLab REST API
+// properator needs.
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Access levels of project and group members
+const (
+	GuestAccess      = 10
+	ReporterAccess   = 20
+	DeveloperAccess  = 30
+	MaintainerAccess = 40
+	OwnerAccess      = 50
+)
+
+// Client talks to the REST API of a GitLab instance as the user owning
+// the token.
+type Client struct {
+	baseURL string
+	token   string
+	sshHost string
+	http    *http.Client
+}
+
+// NewClient creates a client for the instance at baseURL, like
+// https://gitlab.example.com. Repositories are cloned from sshHost, which
+// defaults to the host of baseURL.
+func NewClient(baseURL, token, sshHost string) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, errors.Errorf("expected a URL like https://gitlab.example.com, got %q", baseURL)
+	}
+	if sshHost == "" {
+		sshHost = u.Hostname()
+	}
+	return &Client{
+		baseURL: u.String() + "/api/v4/",
+		token:   token,
+		sshHost: sshHost,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Error is returned for unsuccessful responses.
+type Error struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is set if GitLab told us when to try again
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("gitlab responded with %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound tells us whether err is a 404 from GitLab.
+func IsNotFound(err error) bool {
+	var glErr *Error
+	return errors.As(err, &glErr) && glErr.StatusCode == http.StatusNotFound
+}
+
+// Project identifies a project by its full path, like `group/project`.
+func Project(path string) string {
+	return url.PathEscape(path)
+}
+
+// ProjectID identifies a project by its ID.
+func ProjectID(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// GitURL is how a project is cloned over SSH.
+func (c *Client) GitURL(path string) string {
+	// The scp-like syntax can't have a port
+	if strings.Contains(c.sshHost, ":") {
+		return fmt.Sprintf("ssh://git@%s/%s.git", c.sshHost, path)
+	}
+	return fmt.Sprintf("git@%s:%s.git", c.sshHost, path)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "couldn't encode request")
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Private-Token", c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		contents, _ := ioutil.ReadAll(resp.Body)
+		glErr := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(contents))}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			glErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return glErr
+	}
+
+	if out == nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(out), "couldn't decode response")
+}
+
+// User is a GitLab user.
+type User struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+// CurrentUser gets the user owning the token.
+func (c *Client) CurrentUser(ctx context.Context) (*User, error) {
+	var user User
+	return &user, c.do(ctx, http.MethodGet, "user", nil, &user)
+}
+
+// UserByName finds a user by their username.
+func (c *Client) UserByName(ctx context.Context, username string) (*User, error) {
+	var users []User
+	if err := c.do(ctx, http.MethodGet, "users?username="+url.QueryEscape(username), nil, &users); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, &Error{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("no user %s", username)}
+	}
+	return &users[0], nil
+}
+
+// Member is a user's membership in a project or group.
+type Member struct {
+	AccessLevel int    `json:"access_level"`
+	State       string `json:"state"`
+}
+
+// ProjectMember gets the membership of a user in a project, including
+// inherited memberships.
+func (c *Client) ProjectMember(ctx context.Context, project string, userID int64) (*Member, error) {
+	var member Member
+	return &member, c.do(ctx, http.MethodGet, fmt.Sprintf("projects/%s/members/all/%d", project, userID), nil, &member)
+}
+
+// GroupMember gets the membership of a user in a group, like `org/team`,
+// including inherited memberships.
+func (c *Client) GroupMember(ctx context.Context, group string, userID int64) (*Member, error) {
+	var member Member
+	path := fmt.Sprintf("groups/%s/members/all/%d", url.PathEscape(group), userID)
+	return &member, c.do(ctx, http.MethodGet, path, nil, &member)
+}
+
+// Commit is a commit of a merge request.
+type Commit struct {
+	ID string `json:"id"`
+}
+
+// MergeRequest is a GitLab merge request.
+type MergeRequest struct {
+	IID             int    `json:"iid"`
+	State           string `json:"state"`
+	SourceBranch    string `json:"source_branch"`
+	SHA             string `json:"sha"`
+	SourceProjectID int64  `json:"source_project_id"`
+	TargetProjectID int64  `json:"target_project_id"`
+}
+
+// MergeRequest gets a merge request by its IID.
+func (c *Client) MergeRequest(ctx context.Context, project string, iid int) (*MergeRequest, error) {
+	var mr MergeRequest
+	return &mr, c.do(ctx, http.MethodGet, fmt.Sprintf("projects/%s/merge_requests/%d", project, iid), nil, &mr)
+}
+
+// Approvals lists who approved a merge request.
+type Approvals struct {
+	ApprovedBy []struct {
+		User User `json:"user"`
+		// ApprovedAt is only sent by newer GitLab versions
+		ApprovedAt *time.Time `json:"approved_at"`
+	} `json:"approved_by"`
+}
+
+// Approvals gets the approvals of a merge request.
+func (c *Client) Approvals(ctx context.Context, project string, iid int) (*Approvals, error) {
+	var approvals Approvals
+	path := fmt.Sprintf("projects/%s/merge_requests/%d/approvals", project, iid)
+	return &approvals, c.do(ctx, http.MethodGet, path, nil, &approvals)
+}
+
+// MergeRequestVersion is the state of a merge request after a push.
+type MergeRequestVersion struct {
+	HeadCommitSHA string    `json:"head_commit_sha"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// MergeRequestVersions lists the versions of a merge request, newest first.
+func (c *Client) MergeRequestVersions(ctx context.Context, project string, iid int) ([]MergeRequestVersion, error) {
+	var versions []MergeRequestVersion
+	path := fmt.Sprintf("projects/%s/merge_requests/%d/versions?per_page=100", project, iid)
+	return versions, c.do(ctx, http.MethodGet, path, nil, &versions)
+}
+
+// ProjectInfo is a GitLab project.
+type ProjectInfo struct {
+	ID                int64  `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	// Visibility is private, internal or public
+	Visibility    string `json:"visibility"`
+	HTTPURLToRepo string `json:"http_url_to_repo"`
+	SSHURLToRepo  string `json:"ssh_url_to_repo"`
+	// ResetApprovalsOnPush isn't sent by GitLab editions without the setting
+	ResetApprovalsOnPush *bool `json:"reset_approvals_on_push"`
+}
+
+// GetProject gets a project.
+func (c *Client) GetProject(ctx context.Context, project string) (*ProjectInfo, error) {
+	var info ProjectInfo
+	return &info, c.do(ctx, http.MethodGet, "projects/"+project, nil, &info)
+}
+
+// Note is a comment on a merge request.
+type Note struct {
+	ID int64 `json:"id"`
+}
+
+// CreateNote comments on a merge request.
+func (c *Client) CreateNote(ctx context.Context, project string, iid int, body string) (*Note, error) {
+	var note Note
+	path := fmt.Sprintf("projects/%s/merge_requests/%d/notes", project, iid)
+	return &note, c.do(ctx, http.MethodPost, path, map[string]string{"body": body}, &note)
+}
+
+// EditNote replaces the body of a comment on a merge request.
+func (c *Client) EditNote(ctx context.Context, project string, iid int, noteID int64, body string) error {
+	path := fmt.Sprintf("projects/%s/merge_requests/%d/notes/%d", project, iid, noteID)
+	return c.do(ctx, http.MethodPut, path, map[string]string{"body": body}, nil)
+}
+
+// AwardEmoji reacts to a comment on a merge request.
+func (c *Client) AwardEmoji(ctx context.Context, project string, iid int, noteID int64, name string) error {
+	path := fmt.Sprintf("projects/%s/merge_requests/%d/notes/%d/award_emoji", project, iid, noteID)
+	return c.do(ctx, http.MethodPost, path, map[string]string{"name": name}, nil)
+}
+
+// DeployKey is an SSH key with access to a project.
+type DeployKey struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Key   string `json:"key"`
+}
+
+// AddDeployKey gives an SSH key read access to a project.
+func (c *Client) AddDeployKey(ctx context.Context, project, title, key string) (*DeployKey, error) {
+	var deployKey DeployKey
+	body := map[string]interface{}{"title": title, "key": key, "can_push": false}
+	return &deployKey, c.do(ctx, http.MethodPost, fmt.Sprintf("projects/%s/deploy_keys", project), body, &deployKey)
+}
+
+// DeployKeys lists the deploy keys of a project.
+func (c *Client) DeployKeys(ctx context.Context, project string) ([]DeployKey, error) {
+	var keys []DeployKey
+	return keys, c.do(ctx, http.MethodGet, fmt.Sprintf("projects/%s/deploy_keys?per_page=100", project), nil, &keys)
+}
+
+// DeleteDeployKey removes a deploy key from a project.
+func (c *Client) DeleteDeployKey(ctx context.Context, project string, id int64) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("projects/%s/deploy_keys/%d", project, id), nil, nil)
+}
+
+// Deployment statuses
+const (
+	DeploymentRunning  = "running"
+	DeploymentSuccess  = "success"
+	DeploymentFailed   = "failed"
+	DeploymentCanceled = "canceled"
+)
+
+// Deployment is a deployment of a commit to an environment.
+type Deployment struct {
+	ID  int64  `json:"id"`
+	SHA string `json:"sha"`
+}
+
+// CreateDeployment creates a running deployment of sha to environment.
+func (c *Client) CreateDeployment(ctx context.Context, project, environment, ref, sha string) (*Deployment, error) {
+	body := map[string]interface{}{
+		"environment": environment,
+		"ref":         ref,
+		"sha":         sha,
+		"tag":         false,
+		"status":      DeploymentRunning,
+	}
+	var deployment Deployment
+	return &deployment, c.do(ctx, http.MethodPost, fmt.Sprintf("projects/%s/deployments", project), body, &deployment)
+}
+
+// UpdateDeployment sets the status of a deployment.
+func (c *Client) UpdateDeployment(ctx context.Context, project string, id int64, status string) error {
+	path := fmt.Sprintf("projects/%s/deployments/%d", project, id)
+	return c.do(ctx, http.MethodPut, path, map[string]string{"status": status}, nil)
+}
+
+type environment struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func (c *Client) environment(ctx context.Context, project, name string) (*environment, error) {
+	var environments []environment
+	path := fmt.Sprintf("projects/%s/environments?name=%s", project, url.QueryEscape(name))
+	if err := c.do(ctx, http.MethodGet, path, nil, &environments); err != nil {
+		return nil, err
+	}
+	for i := range environments {
+		if environments[i].Name == name {
+			return &environments[i], nil
+		}
+	}
+	return nil, &Error{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("no environment %s", name)}
+}
+
+// SetEnvironmentURL sets the external URL of an environment.
+func (c *Client) SetEnvironmentURL(ctx context.Context, project, name, externalURL string) error {
+	env, err := c.environment(ctx, project, name)
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("projects/%s/environments/%d", project, env.ID)
+	return c.do(ctx, http.MethodPut, path, map[string]string{"external_url": externalURL}, nil)
+}
+
+// StopEnvironment stops an environment, if it exists.
+func (c *Client) StopEnvironment(ctx context.Context, project, name string) error {
+	env, err := c.environment(ctx, project, name)
+	if IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("projects/%s/environments/%d/stop", project, env.ID), nil, nil)
+}
@@ -0,0 +1,140 @@
+package gitlab
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Types of the webhook events we handle, named like GitHub's so they can be
+// stored alongside them.
+const (
+	NoteHook         = "gitlab_note"
+	MergeRequestHook = "gitlab_merge_request"
+)
+
+var hookTypes = map[string]string{
+	"Note Hook":          NoteHook,
+	"Merge Request Hook": MergeRequestHook,
+}
+
+// WebHookType gives the type of a delivery, empty if we don't handle it.
+func WebHookType(r *http.Request) string {
+	return hookTypes[r.Header.Get("X-Gitlab-Event")]
+}
+
+// DeliveryID identifies a delivery. Older GitLab versions don't send one.
+func DeliveryID(r *http.Request) string {
+	return r.Header.Get("X-Gitlab-Event-UUID")
+}
+
+// ValidatePayload checks the secret token of a delivery and reads its payload.
+func ValidatePayload(r *http.Request, token []byte) ([]byte, error) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), token) != 1 {
+		return nil, errors.New("invalid X-Gitlab-Token")
+	}
+	return ioutil.ReadAll(r.Body)
+}
+
+// ParseWebHook parses the payload of a webhook event of type eventType.
+func ParseWebHook(eventType string, payload []byte) (interface{}, error) {
+	var event interface{}
+	switch eventType {
+	case NoteHook:
+		event = &NoteEvent{}
+	case MergeRequestHook:
+		event = &MergeRequestEvent{}
+	default:
+		return nil, errors.Errorf("unknown GitLab event type %q", eventType)
+	}
+	return event, json.Unmarshal(payload, event)
+}
+
+// EventUser is who triggered an event.
+type EventUser struct {
+	Username string `json:"username"`
+}
+
+// EventProject is where an event happened.
+type EventProject struct {
+	ID                int64  `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+}
+
+// Label is a label of a merge request.
+type Label struct {
+	Title string `json:"title"`
+}
+
+// EventMergeRequest is a merge request as webhooks describe it.
+type EventMergeRequest struct {
+	IID          int    `json:"iid"`
+	State        string `json:"state"`
+	SourceBranch string `json:"source_branch"`
+	LastCommit   Commit `json:"last_commit"`
+	// The projects differ for merge requests from forks
+	SourceProjectID int64 `json:"source_project_id"`
+	TargetProjectID int64 `json:"target_project_id"`
+}
+
+// NoteEvent is sent for comments.
+type NoteEvent struct {
+	User             EventUser    `json:"user"`
+	Project          EventProject `json:"project"`
+	ObjectAttributes struct {
+		ID           int64  `json:"id"`
+		Note         string `json:"note"`
+		NoteableType string `json:"noteable_type"`
+		// Action is create or update, older GitLab versions leave it out
+		Action string `json:"action"`
+	} `json:"object_attributes"`
+	// MergeRequest is only set for comments on merge requests
+	MergeRequest *EventMergeRequest `json:"merge_request"`
+}
+
+// MergeRequestEvent is sent when a merge request changes.
+type MergeRequestEvent struct {
+	User             EventUser    `json:"user"`
+	Project          EventProject `json:"project"`
+	ObjectAttributes struct {
+		EventMergeRequest
+		// Action is open, close, reopen, update, approved, unapproved or merge
+		Action string `json:"action"`
+		// OldRev is set for updates pushing new commits
+		OldRev string `json:"oldrev"`
+	} `json:"object_attributes"`
+	Labels  []Label `json:"labels"`
+	Changes struct {
+		Labels *struct {
+			Previous []Label `json:"previous"`
+			Current  []Label `json:"current"`
+		} `json:"labels"`
+	} `json:"changes"`
+}
+
+func hasLabel(labels []Label, title string) bool {
+	for _, l := range labels {
+		if l.Title == title {
+			return true
+		}
+	}
+	return false
+}
+
+// HasLabel tells us whether the merge request has a label.
+func (e *MergeRequestEvent) HasLabel(title string) bool {
+	return hasLabel(e.Labels, title)
+}
+
+// LabelChanged tells us whether a label was added or removed by this event.
+func (e *MergeRequestEvent) LabelChanged(title string) (added, removed bool) {
+	change := e.Changes.Labels
+	if change == nil {
+		return false, false
+	}
+	before, after := hasLabel(change.Previous, title), hasLabel(change.Current, title)
+	return !before && after, before && !after
+}
@@ -3,9 +3,11 @@ package utils
 import (
 	"context"
 	"io/ioutil"
+	"os"
 	"reflect"
 
 	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -22,15 +24,37 @@ func CreateOrReplace(ctx context.Context, r client.Reader, c client.Client, obj
 		if err := c.Create(ctx, obj); err != nil {
 			return errors.Wrapf(err, "couldn't create %s", typ.Name())
 		}
-	} else if err := c.Update(ctx, obj); err != nil {
+		return nil
+	}
+
+	// Custom resources can't be updated without a resourceVersion
+	existing, err := meta.Accessor(ignored)
+	if err != nil {
+		return err
+	}
+	replacement, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	replacement.SetResourceVersion(existing.GetResourceVersion())
+
+	if err := c.Update(ctx, obj); err != nil {
 		return errors.Wrapf(err, "couldn't update %s", typ.Name())
 	}
 
 	return nil
 }
 
+// NamespaceEnv overrides the namespace of the running pod, for running
+// outside of the cluster.
+const NamespaceEnv = "POD_NAMESPACE"
+
 // GetCurrentNamespace gives us the namespace of the running pod.
 func GetCurrentNamespace() (string, error) {
+	if ns := os.Getenv(NamespaceEnv); ns != "" {
+		return ns, nil
+	}
+
 	data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
 	if err != nil {
 		return "", errors.Wrap(err, "couldn't read namespace from server account")
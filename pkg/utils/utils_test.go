@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCreateOrReplace(t *testing.T) {
+	ctx := context.Background()
+	k8s := fake.NewFakeClient()
+	nn := types.NamespacedName{Name: "config", Namespace: "properator"}
+	configMap := func(value string) *v1.ConfigMap {
+		return &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: nn.Name, Namespace: nn.Namespace},
+			Data:       map[string]string{"key": value},
+		}
+	}
+
+	assert.NoError(t, CreateOrReplace(ctx, k8s, k8s, configMap("first")))
+
+	// The replacement doesn't know the resourceVersion of what it replaces
+	assert.NoError(t, CreateOrReplace(ctx, k8s, k8s, configMap("second")))
+
+	var found v1.ConfigMap
+	assert.NoError(t, k8s.Get(ctx, nn, &found))
+	assert.Equal(t, map[string]string{"key": "second"}, found.Data)
+}